@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+	"wasolgo/internal/archive"
+	"wasolgo/internal/config"
+	"wasolgo/internal/database"
+	"wasolgo/internal/redis"
+
+	rdb "github.com/redis/go-redis/v9"
+)
+
+const chatsUsage = `Usage:
+  wasolgo chats migrate-headers [--dry-run]
+  wasolgo chats merge [--chat <id>] [--apply]
+  wasolgo chats reindex`
+
+func runChats(env config.EnvVars, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, chatsUsage)
+		return 2
+	}
+
+	redisConn, err := redis.ConnectRedis(env.RedisUrl)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Couldn't connect to Redis: %v\n", err)
+		return 1
+	}
+	defer redisConn.Close()
+
+	switch args[0] {
+	case "migrate-headers":
+		err = migrateHeaders(redisConn, args[1:])
+	case "merge":
+		err = mergeChats(env, redisConn, args[1:])
+	case "reindex":
+		err = reindexChats(redisConn)
+	default:
+		fmt.Fprintln(os.Stderr, chatsUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// migrateHeaders converts every chat:<id> list header in the chats set to a
+// hash header.
+func migrateHeaders(redisConn *rdb.Client, args []string) error {
+	fs := flag.NewFlagSet("migrate-headers", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "only report what would be converted")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	var lists, hashes, missing, failed int
+	iter := redisConn.SScan(ctx, "chats", 0, "", 500).Iterator()
+	for iter.Next(ctx) {
+		chatID := iter.Val()
+		keyType, err := redisConn.Type(ctx, "chat:"+chatID).Result()
+		if err != nil {
+			return err
+		}
+		switch keyType {
+		case redis.LayoutHash:
+			hashes++
+			continue
+		case "none":
+			missing++
+			continue
+		case redis.LayoutList:
+		default:
+			fmt.Printf("SKIP %s: unexpected key type %s\n", chatID, keyType)
+			failed++
+			continue
+		}
+		if *dryRun {
+			lists++
+			continue
+		}
+		converted, err := redis.ConvertChatHeader(ctx, redisConn, chatID)
+		if err != nil {
+			fmt.Printf("FAIL %s: %v\n", chatID, err)
+			failed++
+			continue
+		}
+		if converted {
+			lists++
+		} else {
+			hashes++
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	verb := "Converted"
+	if *dryRun {
+		verb = "Would convert"
+	}
+	fmt.Printf("%s %d list headers; %d already hashes, %d missing, %d failed\n", verb, lists, hashes, missing, failed)
+	return nil
+}
+
+// reindexChats adds every chat in the chats set to the activity and inbox
+// indexes, for chats last touched before the indexes existed.
+func reindexChats(redisConn *rdb.Client) error {
+	ctx := context.Background()
+	var indexed, missing, failed int
+	iter := redisConn.SScan(ctx, "chats", 0, "", 500).Iterator()
+	for iter.Next(ctx) {
+		chatID := iter.Val()
+		found, err := redis.IndexChat(ctx, redisConn, chatID)
+		switch {
+		case err != nil:
+			fmt.Printf("FAIL %s: %v\n", chatID, err)
+			failed++
+		case !found:
+			missing++
+		default:
+			indexed++
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	fmt.Printf("Indexed %d chats; %d missing, %d failed\n", indexed, missing, failed)
+	return nil
+}
+
+// mergeChats finds chats stored under several variants of the same number
+// and folds each group into its canonical ID, in Redis and in Postgres. It
+// only reports the groups unless --apply is given.
+func mergeChats(env config.EnvVars, redisConn *rdb.Client, args []string) error {
+	fs := flag.NewFlagSet("merge", flag.ContinueOnError)
+	only := fs.String("chat", "", "only merge the group of this chat ID")
+	apply := fs.Bool("apply", false, "merge the chats instead of reporting them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	groups, err := duplicateChats(ctx, redisConn)
+	if err != nil {
+		return err
+	}
+	if *only != "" {
+		target := redis.NormalizeChatID(*only)
+		groups = map[string][]string{target: groups[target]}
+		if len(groups[target]) < 2 {
+			fmt.Printf("No duplicates found for %s\n", *only)
+			return nil
+		}
+	}
+	if len(groups) == 0 {
+		fmt.Println("No duplicate chats found")
+		return nil
+	}
+
+	db, err := database.ConnectDb(env.DbUrl)
+	if err != nil {
+		return fmt.Errorf("couldn't connect to database: %w", err)
+	}
+	defer db.Close()
+
+	targets := make([]string, 0, len(groups))
+	for target := range groups {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	var merged, failed int
+	for _, target := range targets {
+		ids := groups[target]
+		plan, err := redis.MergeChats(ctx, redisConn, target, ids, false)
+		if err != nil {
+			fmt.Printf("FAIL %s: %v\n", target, err)
+			failed++
+			continue
+		}
+		counts, err := database.CountChatMessages(db, append([]string{target}, plan.Sources...))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s <- %v\n", target, plan.Sources)
+		for _, id := range append([]string{target}, plan.Sources...) {
+			fmt.Printf("  %-32s redis=%d archived=%d db=%d\n", id, plan.Messages[id], plan.Archived[id], counts[id])
+		}
+		fmt.Printf("  merged: %d messages, header from %s\n", plan.Merged, plan.HeaderFrom)
+		if !*apply {
+			continue
+		}
+		if err := applyChatMerge(ctx, db, redisConn, target, ids); err != nil {
+			fmt.Printf("FAIL %s: %v\n", target, err)
+			failed++
+			continue
+		}
+		merged++
+	}
+
+	if !*apply {
+		fmt.Printf("Would merge %d groups of duplicate chats; run with --apply to merge them\n", len(groups)-failed)
+		return nil
+	}
+	fmt.Printf("Merged %d groups of duplicate chats, %d failed\n", merged, failed)
+	return nil
+}
+
+// mergeLockTTL bounds how long a crashed merge keeps the archiver off the
+// chats it was merging.
+const mergeLockTTL = 10 * time.Minute
+
+// applyChatMerge moves the Postgres references and then merges the Redis
+// chats, holding the archiver's locks on every chat of the group so their
+// archived counts stay as planned. Both steps can be run again once done, so
+// when the Redis merge fails after the commit, running the merge for the chat
+// again completes it.
+func applyChatMerge(ctx context.Context, db *sql.DB, redisConn *rdb.Client, target string, ids []string) error {
+	for _, id := range ids {
+		unlock, err := archive.Lock(ctx, redisConn, id, mergeLockTTL)
+		if err != nil {
+			return err
+		}
+		if unlock == nil {
+			return fmt.Errorf("chat %s is being archived, try again later", id)
+		}
+		defer unlock()
+	}
+	plan, err := redis.MergeChats(ctx, redisConn, target, ids, false)
+	if err != nil {
+		return err
+	}
+	moved, err := database.MergeChatIDs(db, target, plan.HeaderFrom, plan.Sources, plan.Archived)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("  moved %d database messages\n", moved)
+	if _, err := redis.MergeChats(ctx, redisConn, target, ids, true); err != nil {
+		return fmt.Errorf("database is merged but redis isn't, run `wasolgo chats merge --chat %s --apply` again to finish: %w", target, err)
+	}
+	return nil
+}
+
+// duplicateChats groups the IDs of the chats set that are variants of the
+// same number, keyed by the canonical ID. Only groups with more than one chat
+// are returned.
+func duplicateChats(ctx context.Context, redisConn *rdb.Client) (map[string][]string, error) {
+	ids := map[string]bool{}
+	iter := redisConn.SScan(ctx, "chats", 0, "", 500).Iterator()
+	for iter.Next(ctx) {
+		ids[iter.Val()] = true
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	groups := map[string][]string{}
+	grouped := map[string]bool{}
+	for id := range ids {
+		if grouped[id] {
+			continue
+		}
+		target := redis.NormalizeChatID(id)
+		for _, variant := range redis.PossibleChatIDs(target) {
+			if ids[variant] && !grouped[variant] {
+				grouped[variant] = true
+				groups[target] = append(groups[target], variant)
+			}
+		}
+		if !grouped[id] {
+			grouped[id] = true
+			groups[target] = append(groups[target], id)
+		}
+	}
+	for target, members := range groups {
+		if len(members) < 2 {
+			delete(groups, target)
+		}
+	}
+	return groups, nil
+}
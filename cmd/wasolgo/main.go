@@ -4,15 +4,22 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"sync"
 	"syscall"
 	"time"
+	"wasolgo/internal/api"
+	"wasolgo/internal/archive"
+	"wasolgo/internal/chatstore"
 	"wasolgo/internal/config"
 	consumer "wasolgo/internal/consume"
 	"wasolgo/internal/database"
+	"wasolgo/internal/delivery"
 	"wasolgo/internal/redis"
+
+	rdb "github.com/redis/go-redis/v9"
 )
 
 func main() {
@@ -21,12 +28,87 @@ func main() {
 		fmt.Printf("Error: Couldn't retrieve .env: %v", err)
 	}
 
+	allowedCIDRs, err := api.ParseCIDRs(env.HTTPAllowedCIDRs)
+	if err != nil {
+		log.Fatalf("ERROR: Invalid HTTP_ALLOWED_CIDRS: %v", err)
+	}
+	proxy, err := api.ParseProxy(env.HTTPProxy)
+	if err != nil {
+		log.Fatalf("ERROR: Invalid HTTP_OUTBOUND_PROXY: %v", err)
+	}
+	api.Configure(api.ClientConfig{
+		ConnectTimeout:      env.HTTPConnectTimeout,
+		ResponseTimeout:     env.HTTPResponseTimeout,
+		Timeout:             env.HTTPTimeout,
+		MaxIdleConnsPerHost: env.HTTPMaxIdleConnsPerHost,
+		HostRate:            env.HTTPHostRate,
+		HostBurst:           env.HTTPHostBurst,
+		InstanceRate:        env.EvolutionInstanceRate,
+		InstanceBurst:       env.EvolutionInstanceBurst,
+		Proxy:               proxy,
+		Policy: api.Policy{
+			AllowedHosts:  env.HTTPAllowedHosts,
+			AllowedCIDRs:  allowedCIDRs,
+			AllowlistOnly: env.HTTPAllowlistOnly,
+			AllowPrivate:  env.HTTPAllowPrivate,
+		},
+	})
+
+	if err := redis.SetHeaderLayout(env.ChatHeaderLayout); err != nil {
+		log.Fatalf("ERROR: Invalid CHAT_HEADER_LAYOUT: %v", err)
+	}
+	redis.SetFeed(redis.FeedConfig{
+		Enabled: env.ChatFeed,
+		MaxLen:  int64(env.ChatFeedMaxLen),
+		PubSub:  env.ChatFeedPubSub,
+		Groups:  env.ChatFeedGroups,
+	})
+	reopenPolicies, err := chatstore.ParseReopenPolicies(env.ChatReopenPolicies)
+	if err != nil {
+		log.Fatalf("ERROR: Invalid CHAT_REOPEN_POLICIES: %v", err)
+	}
+	if err := chatstore.ConfigureLifecycle(chatstore.LifecycleConfig{
+		DefaultDepartment:  env.ChatDefaultDepartment,
+		ReopenPolicy:       env.ChatReopenPolicy,
+		DepartmentPolicies: reopenPolicies,
+	}); err != nil {
+		log.Fatalf("ERROR: Invalid chat reopen policy: %v", err)
+	}
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "webhooks":
+			os.Exit(runWebhooks(env, os.Args[2:]))
+		case "chats":
+			os.Exit(runChats(env, os.Args[2:]))
+		default:
+			fmt.Fprintf(os.Stderr, "Unknown command %q\n", os.Args[1])
+			os.Exit(2)
+		}
+	}
+
 	log.Print("Starting application - Check Logs below...")
+	if env.MetricsAddr != "" {
+		go func() {
+			// expvar registers /debug/vars on the default mux.
+			if err := http.ListenAndServe(env.MetricsAddr, nil); err != nil {
+				log.Printf("ERROR: Metrics server stopped: %v", err)
+			}
+		}()
+	}
 	log.Print("Starting WaSolConsumer")
 
-	redisConn, err := redis.ConnectRedis(env.RedisUrl)
-	if err != nil {
-		log.Fatalf("ERROR: Couldn't connect to Redis: %v", err)
+	var store chatstore.Store
+	var redisConn *rdb.Client
+	if env.DryRun {
+		log.Print("DRY_RUN is set, chats are kept in memory and not written to Redis")
+		store = chatstore.NewMemory()
+	} else {
+		redisConn, err = redis.ConnectRedis(env.RedisUrl)
+		if err != nil {
+			log.Fatalf("ERROR: Couldn't connect to Redis: %v", err)
+		}
+		store = chatstore.NewRedis(redisConn)
 	}
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
@@ -40,6 +122,46 @@ func main() {
 			continue
 		}
 
+		if err := database.Migrate(dbClient); err != nil {
+			log.Printf("ERROR: Couldn't apply database migrations, retrying... : %v", err)
+			dbClient.Close()
+			time.Sleep(30 * time.Second)
+			continue
+		}
+
+		webhooks, err := database.NewWebhookRegistry(dbClient, env.DbUrl, env.WebhookRefreshInterval)
+		if err != nil {
+			log.Printf("ERROR: Couldn't load webhooks, retrying... : %v", err)
+			dbClient.Close()
+			time.Sleep(30 * time.Second)
+			continue
+		}
+
+		loopCtx, cancel := context.WithCancel(ctx)
+		go webhooks.Run(loopCtx)
+
+		dispatcher := delivery.NewDispatcher(dbClient, webhooks, delivery.Config{
+			Workers:      env.WebhookWorkers,
+			PollInterval: env.WebhookPollInterval,
+			MaxAttempts:  env.WebhookMaxAttempts,
+			DisableAfter: env.WebhookDisableAfter,
+
+			MaxInFlight:      env.WebhookMaxInFlight,
+			BreakerThreshold: env.WebhookBreakerThreshold,
+			BreakerCooldown:  env.WebhookBreakerCooldown,
+		})
+		go dispatcher.Run(loopCtx)
+
+		retention := archive.Config{
+			Interval:      env.ChatArchiveInterval,
+			KeepMessages:  int64(env.ChatRetentionMessages),
+			KeepFor:       time.Duration(env.ChatRetentionDays) * 24 * time.Hour,
+			FinishedGrace: env.ChatFinishedGrace,
+		}
+		if retention.Enabled() && redisConn != nil {
+			go archive.NewArchiver(dbClient, redisConn, retention).Run(loopCtx)
+		}
+
 		log.Print("Setting up Outgoing and Incoming Request consumers...")
 
 		var wg sync.WaitGroup
@@ -51,7 +173,7 @@ func main() {
 			wg.Add(1)
 			go func(queue string) {
 				defer wg.Done()
-				if err := consumer.RunConsumer(ctx, env.RabbitUrl, dbClient, queue, redisConn); err != nil {
+				if err := consumer.RunConsumer(loopCtx, env.RabbitUrl, dbClient, queue, store, webhooks); err != nil {
 					errCh <- fmt.Errorf("consumer %s failed: %w", queue, err)
 				}
 			}(queueName)
@@ -65,8 +187,10 @@ func main() {
 		select {
 		case <-ctx.Done():
 			log.Print("Shutdown requested, exiting main loop.")
+			cancel()
 			return
 		case err := <-errCh:
+			cancel()
 			log.Printf("Error in consumer loop: %v", err)
 			fmt.Printf("ERROR: Consumer loop failed: %v\n", err)
 			log.Print("Reconnecting in 5 seconds...")
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"wasolgo/internal/api"
+	"wasolgo/internal/config"
+	"wasolgo/internal/database"
+)
+
+const webhooksUsage = `Usage:
+  wasolgo webhooks list
+  wasolgo webhooks test <webhook-id>
+  wasolgo webhooks replay [--since TIME] [--until TIME] [--chat CHAT_ID] [--webhook ID] [--status STATUS] [--dry-run]
+
+TIME is RFC3339 (2024-05-01T00:00:00Z) or a duration ago (24h).`
+
+func runWebhooks(env config.EnvVars, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, webhooksUsage)
+		return 2
+	}
+
+	db, err := database.ConnectDb(env.DbUrl)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Couldn't connect to Database: %v\n", err)
+		return 1
+	}
+	defer db.Close()
+
+	switch args[0] {
+	case "list":
+		err = listWebhooks(db)
+	case "test":
+		err = testWebhook(db, args[1:])
+	case "replay":
+		err = replayDeliveries(db, args[1:])
+	default:
+		fmt.Fprintln(os.Stderr, webhooksUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func listWebhooks(db *sql.DB) error {
+	webhooks, err := database.GetAllWebhooks(db)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tENABLED\tFORMAT\tCONN\tEVENTS\tSIGNED\tURL")
+	for _, wh := range *webhooks {
+		conn := "*"
+		if wh.Conn != nil && !wh.IsGlobal {
+			conn = *wh.Conn
+		}
+		events := strings.Join(wh.Events, ",")
+		if events == "" {
+			var legacy []string
+			if wh.ReceiveMessage {
+				legacy = append(legacy, api.EventMessageReceived)
+			}
+			if wh.SendMessage {
+				legacy = append(legacy, api.EventMessageSent)
+			}
+			events = strings.Join(legacy, ",")
+		}
+		format := wh.Format
+		if wh.BodyTemplate != "" {
+			format = "template"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%t\t%s\t%s\t%s\t%t\t%s\n", wh.ID, wh.Name, wh.Enabled, format, conn, events, wh.Secret != "", wh.Url)
+	}
+	return w.Flush()
+}
+
+func testWebhook(db *sql.DB, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("test takes exactly one webhook id")
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid webhook id %q", args[0])
+	}
+	wh, err := database.GetWebhook(db, id)
+	if err != nil {
+		return fmt.Errorf("couldn't load webhook %d: %w", id, err)
+	}
+
+	ev := api.NewEvent("webhook.test")
+	ev.Instance = "test-instance"
+	if wh.Conn != nil {
+		ev.Instance = *wh.Conn
+	}
+	ev.Chat = &api.EventChat{ID: "5511999999999@s.whatsapp.net", Situation: "enqueued", IsOpen: true}
+	ev.Customer = &api.EventCustomer{Number: "5511999999999", Name: "Test Customer"}
+	ev.Message = &api.EventMessage{
+		ID:        "TEST" + strings.ToUpper(ev.ID[:12]),
+		Direction: "inbound",
+		Type:      "text",
+		Text:      "This is a test event sent by wasolgo.",
+		From:      "5511999999999@s.whatsapp.net",
+		Timestamp: ev.OccurredAt.Format(time.RFC3339),
+	}
+
+	body, contentType, err := api.RenderEvent(wh, ev)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Sending test event %s to webhook %d (%s)\n", ev.ID, wh.ID, wh.Url)
+	start := time.Now()
+	resp, err := api.SendWebhook(wh, ev.ID, contentType, body)
+	latency := time.Since(start)
+	if resp != nil {
+		fmt.Printf("Status: %s (%s)\nBody: %s\n", resp.Status, latency.Round(time.Millisecond), resp.Body)
+	}
+	return err
+}
+
+func replayDeliveries(db *sql.DB, args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	since := fs.String("since", "", "only deliveries created at or after TIME")
+	until := fs.String("until", "", "only deliveries created before TIME")
+	chatID := fs.String("chat", "", "only deliveries for this chat ID")
+	webhookID := fs.Int("webhook", 0, "only deliveries to this webhook ID")
+	status := fs.String("status", "", "only deliveries in this status (pending, delivered, failed, cancelled)")
+	dryRun := fs.Bool("dry-run", false, "only count matching deliveries")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	filter := database.DeliveryFilter{ChatID: *chatID, WebhookID: *webhookID, Status: *status}
+	var err error
+	if filter.Since, err = parseTime(*since); err != nil {
+		return fmt.Errorf("invalid --since: %w", err)
+	}
+	if filter.Until, err = parseTime(*until); err != nil {
+		return fmt.Errorf("invalid --until: %w", err)
+	}
+	if filter.Since == nil && filter.ChatID == "" {
+		return fmt.Errorf("replay needs --since or --chat")
+	}
+
+	if *dryRun {
+		n, err := database.CountDeliveries(db, filter)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d deliveries would be re-delivered\n", n)
+		return nil
+	}
+	n, err := database.RequeueDeliveries(db, filter)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Requeued %d deliveries; the running consumer will re-deliver them\n", n)
+	return nil
+}
+
+func parseTime(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		t := time.Now().Add(-d)
+		return &t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
@@ -0,0 +1,198 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strings"
+	"wasolgo/internal/parser"
+)
+
+func buildURL(rawURL string, params map[string]string) (string, error) {
+	if len(params) == 0 {
+		return rawURL, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid request url: %w", err)
+	}
+	q := u.Query()
+	for key, value := range params {
+		q.Set(key, value)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// buildBody encodes req.Body according to req.BodyType and returns the reader
+// together with the Content-Type it should be sent with.
+func buildBody(req *parser.Request) (io.Reader, string, error) {
+	switch strings.ToLower(req.BodyType) {
+	case "", parser.BodyTypeJSON:
+		if isEmptyBody(req.Body) {
+			return nil, "application/json", nil
+		}
+		if !json.Valid(req.Body) {
+			return nil, "", fmt.Errorf("request body is not valid json")
+		}
+		return bytes.NewReader(req.Body), "application/json", nil
+	case parser.BodyTypeForm:
+		fields, err := bodyFields(req.Body)
+		if err != nil {
+			return nil, "", err
+		}
+		return strings.NewReader(fields.Encode()), "application/x-www-form-urlencoded", nil
+	case parser.BodyTypeMultipart:
+		return buildMultipart(req)
+	case parser.BodyTypeRaw:
+		if isEmptyBody(req.Body) {
+			return nil, "text/plain; charset=utf-8", nil
+		}
+		var raw string
+		if err := json.Unmarshal(req.Body, &raw); err != nil {
+			return nil, "", fmt.Errorf("raw request body must be a json string: %w", err)
+		}
+		return strings.NewReader(raw), "text/plain; charset=utf-8", nil
+	}
+	return nil, "", fmt.Errorf("unsupported body_type %q", req.BodyType)
+}
+
+func buildMultipart(req *parser.Request) (io.Reader, string, error) {
+	fields, err := bodyFields(req.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range fields[key] {
+			if err := writer.WriteField(key, value); err != nil {
+				return nil, "", err
+			}
+		}
+	}
+
+	for i, file := range req.Files {
+		if file.Field == "" {
+			return nil, "", fmt.Errorf("file %d has no field name", i)
+		}
+		data, contentType, err := decodeBase64File(file.Base64)
+		if err != nil {
+			return nil, "", fmt.Errorf("file %d: %w", i, err)
+		}
+		if file.ContentType != "" {
+			contentType = file.ContentType
+		}
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		fileName := file.FileName
+		if fileName == "" {
+			fileName = file.Field
+		}
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, escapeQuotes(file.Field), escapeQuotes(fileName)))
+		header.Set("Content-Type", contentType)
+		part, err := writer.CreatePart(header)
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err := part.Write(data); err != nil {
+			return nil, "", err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, "", err
+	}
+	return &buf, writer.FormDataContentType(), nil
+}
+
+// bodyFields flattens a JSON object into form values. Arrays become repeated
+// keys and nested objects are sent as their JSON encoding.
+func bodyFields(body json.RawMessage) (url.Values, error) {
+	values := url.Values{}
+	if isEmptyBody(body) {
+		return values, nil
+	}
+	var obj map[string]interface{}
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return nil, fmt.Errorf("form request body must be a json object: %w", err)
+	}
+	for key, value := range obj {
+		switch v := value.(type) {
+		case []interface{}:
+			for _, item := range v {
+				s, err := formValue(item)
+				if err != nil {
+					return nil, err
+				}
+				values.Add(key, s)
+			}
+		default:
+			s, err := formValue(v)
+			if err != nil {
+				return nil, err
+			}
+			values.Add(key, s)
+		}
+	}
+	return values, nil
+}
+
+func formValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case float64, bool:
+		return fmt.Sprint(v), nil
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+}
+
+func decodeBase64File(value string) ([]byte, string, error) {
+	var contentType string
+	if strings.HasPrefix(value, "data:") {
+		comma := strings.Index(value, ",")
+		if comma == -1 {
+			return nil, "", fmt.Errorf("invalid data uri")
+		}
+		meta := value[len("data:"):comma]
+		contentType = strings.TrimSuffix(meta, ";base64")
+		value = value[comma+1:]
+	}
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid base64 content: %w", err)
+	}
+	return data, contentType, nil
+}
+
+func isEmptyBody(body json.RawMessage) bool {
+	trimmed := bytes.TrimSpace(body)
+	return len(trimmed) == 0 || bytes.Equal(trimmed, []byte("null"))
+}
+
+func escapeQuotes(s string) string {
+	return strings.NewReplacer("\\", "\\\\", `"`, "\\\"").Replace(s)
+}
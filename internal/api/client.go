@@ -0,0 +1,186 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ClientConfig struct {
+	ConnectTimeout      time.Duration
+	ResponseTimeout     time.Duration
+	Timeout             time.Duration
+	IdleConnTimeout     time.Duration
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+
+	// HostRate and InstanceRate are requests per second; zero disables the
+	// limiter.
+	HostRate      float64
+	HostBurst     int
+	InstanceRate  float64
+	InstanceBurst int
+
+	// Proxy picks the proxy for each request, as http.Transport.Proxy does.
+	// Proxied requests are checked against Policy before they are handed to
+	// the proxy, and the proxy address itself goes through the dial checks, so
+	// a proxy on a private network must be allowed in Policy. The proxy
+	// resolves and dials the destination itself, so that check can't pin the
+	// address actually reached: a host rebinding its DNS between the two
+	// lookups gets through. The proxy must enforce its own egress rules.
+	Proxy func(*http.Request) (*url.URL, error)
+
+	Policy Policy
+}
+
+func DefaultClientConfig() ClientConfig {
+	return ClientConfig{
+		ConnectTimeout:      5 * time.Second,
+		ResponseTimeout:     30 * time.Second,
+		Timeout:             60 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 10,
+		Proxy:               http.ProxyFromEnvironment,
+	}
+}
+
+// ParseProxy returns the ClientConfig.Proxy for a setting: empty uses the
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables, "none" connects
+// directly, and anything else is the URL of the proxy for every request.
+func ParseProxy(value string) (func(*http.Request) (*url.URL, error), error) {
+	switch value {
+	case "":
+		return http.ProxyFromEnvironment, nil
+	case "none":
+		return func(*http.Request) (*url.URL, error) { return nil, nil }, nil
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy url: %w", err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy url %q", value)
+	}
+	return http.ProxyURL(u), nil
+}
+
+var (
+	clientMu        sync.RWMutex
+	httpClient      *http.Client
+	policy          Policy
+	hostLimiter     *keyedLimiter
+	instanceLimiter *keyedLimiter
+)
+
+func init() {
+	Configure(DefaultClientConfig())
+}
+
+// Configure replaces the shared HTTP client used by SendRequest and
+// SendWebhook. Zero values in cfg fall back to DefaultClientConfig.
+func Configure(cfg ClientConfig) {
+	def := DefaultClientConfig()
+	if cfg.ConnectTimeout <= 0 {
+		cfg.ConnectTimeout = def.ConnectTimeout
+	}
+	if cfg.ResponseTimeout <= 0 {
+		cfg.ResponseTimeout = def.ResponseTimeout
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = def.Timeout
+	}
+	if cfg.IdleConnTimeout <= 0 {
+		cfg.IdleConnTimeout = def.IdleConnTimeout
+	}
+	if cfg.MaxIdleConns <= 0 {
+		cfg.MaxIdleConns = def.MaxIdleConns
+	}
+	if cfg.MaxIdleConnsPerHost <= 0 {
+		cfg.MaxIdleConnsPerHost = def.MaxIdleConnsPerHost
+	}
+	if cfg.Proxy == nil {
+		cfg.Proxy = def.Proxy
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   cfg.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		Proxy:                 guardedProxy(cfg.Proxy, cfg.Policy),
+		DialContext:           guardedDialContext(dialer, cfg.Policy),
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		TLSHandshakeTimeout:   cfg.ConnectTimeout,
+		ResponseHeaderTimeout: cfg.ResponseTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+
+	clientMu.Lock()
+	defer clientMu.Unlock()
+	if httpClient != nil {
+		if old, ok := httpClient.Transport.(*http.Transport); ok {
+			old.CloseIdleConnections()
+		}
+	}
+	httpClient = &http.Client{
+		Transport: transport,
+		Timeout:   cfg.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return fmt.Errorf("stopped after 10 redirects")
+			}
+			return cfg.Policy.checkHost(req.URL.Scheme, req.URL.Hostname())
+		},
+	}
+	policy = cfg.Policy
+	hostLimiter = newKeyedLimiter(cfg.HostRate, cfg.HostBurst)
+	instanceLimiter = newKeyedLimiter(cfg.InstanceRate, cfg.InstanceBurst)
+}
+
+// do sends httpReq on the shared client after waiting for the per-host and,
+// when instance is known, the per-instance rate limiters.
+func do(httpReq *http.Request, instance string) (*http.Response, error) {
+	clientMu.RLock()
+	client, hosts, instances, pol := httpClient, hostLimiter, instanceLimiter, policy
+	clientMu.RUnlock()
+
+	host := httpReq.URL.Hostname()
+	if err := pol.checkHost(httpReq.URL.Scheme, host); err != nil {
+		return nil, err
+	}
+
+	ctx := httpReq.Context()
+	if err := hosts.Wait(ctx, httpReq.URL.Host); err != nil {
+		return nil, err
+	}
+	if err := instances.Wait(ctx, instance); err != nil {
+		return nil, err
+	}
+	return client.Do(httpReq)
+}
+
+// evolutionInstance extracts the instance name from Evolution API routes,
+// which take the form /<controller>/<action>/<instance>.
+func evolutionInstance(u *url.URL) string {
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(segments) < 3 {
+		return ""
+	}
+	switch segments[len(segments)-3] {
+	case "message", "chat":
+		instance, err := url.PathUnescape(segments[len(segments)-1])
+		if err != nil {
+			return ""
+		}
+		return instance
+	}
+	return ""
+}
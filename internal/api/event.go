@@ -0,0 +1,149 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const EventVersion = "1"
+
+// Webhook payload formats, selected per webhook.
+const (
+	FormatLegacy      = "legacy"
+	FormatV1          = "v1"
+	FormatCloudEvents = "cloudevents"
+)
+
+// Event is the versioned envelope stored in the delivery outbox and rendered
+// per webhook format at delivery time.
+type Event struct {
+	Version     string         `json:"version"`
+	ID          string         `json:"id"`
+	Type        string         `json:"type"`
+	OccurredAt  time.Time      `json:"occurred_at"`
+	Instance    string         `json:"instance,omitempty"`
+	PerformedBy string         `json:"performed_by,omitempty"`
+	Chat        *EventChat     `json:"chat,omitempty"`
+	Customer    *EventCustomer `json:"customer,omitempty"`
+	Message     *EventMessage  `json:"message,omitempty"`
+}
+
+type EventChat struct {
+	ID         string `json:"id"`
+	Situation  string `json:"situation,omitempty"`
+	IsOpen     bool   `json:"is_open"`
+	Department string `json:"department,omitempty"`
+	Agent      string `json:"agent,omitempty"`
+	Tag        string `json:"tag,omitempty"`
+	Tabulation string `json:"tabulation,omitempty"`
+}
+
+type EventCustomer struct {
+	Number string `json:"number,omitempty"`
+	Name   string `json:"name,omitempty"`
+}
+
+type EventMessage struct {
+	ID        string      `json:"id,omitempty"`
+	Direction string      `json:"direction"`
+	Type      string      `json:"type,omitempty"`
+	Text      string      `json:"text,omitempty"`
+	From      string      `json:"from,omitempty"`
+	To        string      `json:"to,omitempty"`
+	Timestamp string      `json:"timestamp,omitempty"`
+	Media     *EventMedia `json:"media,omitempty"`
+}
+
+// EventMedia references the media of a message; the content itself is never
+// included in webhook payloads.
+type EventMedia struct {
+	MimeType  string `json:"mime_type,omitempty"`
+	FileName  string `json:"file_name,omitempty"`
+	Extension string `json:"extension,omitempty"`
+	Url       string `json:"url,omitempty"`
+}
+
+func NewEvent(eventType string) *Event {
+	return &Event{
+		Version:    EventVersion,
+		ID:         NewEventID(),
+		Type:       eventType,
+		OccurredAt: time.Now().UTC(),
+	}
+}
+
+type cloudEvent struct {
+	SpecVersion     string `json:"specversion"`
+	ID              string `json:"id"`
+	Source          string `json:"source"`
+	Type            string `json:"type"`
+	Subject         string `json:"subject,omitempty"`
+	Time            string `json:"time"`
+	DataContentType string `json:"datacontenttype"`
+	DataSchema      string `json:"dataschema,omitempty"`
+	Data            *Event `json:"data"`
+}
+
+// Legacy converts the event to the payload sent before events were
+// versioned.
+func (ev *Event) Legacy() WebhookMessage {
+	msg := WebhookMessage{
+		Event:       ev.Type,
+		PerformedBy: ev.PerformedBy,
+		Conn:        ev.Instance,
+	}
+	if ev.Chat != nil {
+		msg.ChatID = ev.Chat.ID
+		msg.Department = ev.Chat.Department
+		msg.Agent = ev.Chat.Agent
+		msg.Tag = ev.Chat.Tag
+		msg.IsOpen = ev.Chat.IsOpen
+	}
+	if ev.Message != nil {
+		msg.Message = ev.Message.Text
+		msg.SentBy = ev.Message.From
+	}
+	return msg
+}
+
+// RenderEvent encodes ev with the webhook's body template, or in its format
+// when it has none, and returns the body with its Content-Type.
+func RenderEvent(wh *Webhook, ev *Event) ([]byte, string, error) {
+	if wh.compileErr != nil {
+		return nil, "", wh.compileErr
+	}
+	if wh.template != nil {
+		return wh.renderTemplate(ev)
+	}
+	switch strings.ToLower(wh.Format) {
+	case "", FormatLegacy:
+		body, err := json.Marshal(ev.Legacy())
+		return body, "application/json", err
+	case FormatV1:
+		body, err := json.Marshal(ev)
+		return body, "application/json", err
+	case FormatCloudEvents:
+		source := "/wasolgo"
+		if ev.Instance != "" {
+			source += "/instances/" + ev.Instance
+		}
+		ce := cloudEvent{
+			SpecVersion:     "1.0",
+			ID:              ev.ID,
+			Source:          source,
+			Type:            "br.com.wasol." + ev.Type,
+			Time:            ev.OccurredAt.Format(time.RFC3339Nano),
+			DataContentType: "application/json",
+			DataSchema:      "urn:wasol:event:v" + ev.Version,
+			Data:            ev,
+		}
+		if ev.Chat != nil {
+			ce.Subject = ev.Chat.ID
+		}
+		body, err := json.Marshal(ce)
+		return body, "application/cloudevents+json", err
+	}
+	return nil, "", fmt.Errorf("unknown webhook format %q", wh.Format)
+}
@@ -0,0 +1,213 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+)
+
+// Policy controls which destinations outgoing requests and webhooks may
+// reach. Private, loopback and link-local addresses are denied unless the
+// host is listed in AllowedHosts or the address falls in AllowedCIDRs.
+type Policy struct {
+	AllowedHosts []string
+	AllowedCIDRs []*net.IPNet
+	// AllowlistOnly denies every host that is not in AllowedHosts.
+	AllowlistOnly bool
+	// AllowPrivate disables the private range check entirely.
+	AllowPrivate bool
+}
+
+type DeniedError struct {
+	Host   string
+	Reason string
+}
+
+func (e *DeniedError) Error() string {
+	return fmt.Sprintf("request to %s denied: %s", e.Host, e.Reason)
+}
+
+var blockedCIDRs = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// ParseCIDRs parses a list of CIDRs or bare IPs.
+func ParseCIDRs(values []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip %q", value)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %q: %w", value, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (p Policy) hostAllowed(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, allowed := range p.AllowedHosts {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if allowed == "" {
+			continue
+		}
+		if strings.HasPrefix(allowed, "*.") {
+			if strings.HasSuffix(host, allowed[1:]) {
+				return true
+			}
+			continue
+		}
+		if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// checkHost runs before DNS resolution and rejects bad schemes and hosts
+// outside the allowlist.
+func (p Policy) checkHost(scheme, host string) error {
+	if scheme != "http" && scheme != "https" {
+		return &DeniedError{Host: host, Reason: fmt.Sprintf("scheme %q is not allowed", scheme)}
+	}
+	if host == "" {
+		return &DeniedError{Host: host, Reason: "empty host"}
+	}
+	if p.AllowlistOnly && !p.hostAllowed(host) {
+		return &DeniedError{Host: host, Reason: "host is not in the allowlist"}
+	}
+	return nil
+}
+
+// checkIP runs after DNS resolution, on the address actually being dialed.
+func (p Policy) checkIP(host string, ip net.IP) error {
+	if p.AllowPrivate {
+		return nil
+	}
+	for _, n := range p.AllowedCIDRs {
+		if n.Contains(ip) {
+			return nil
+		}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, n := range blockedCIDRs {
+		if n.Contains(ip) {
+			return &DeniedError{Host: host, Reason: fmt.Sprintf("address %s is in blocked range %s", ip, n)}
+		}
+	}
+	return nil
+}
+
+// guardedProxy wraps proxy so that requests it sends through a proxy are
+// checked first. The dial only sees the proxy's address, so the destination
+// is resolved here and its addresses are checked like a direct dial would.
+// This is a pre-flight check only: the proxy does its own lookup, which this
+// one can't pin, and allowlisted hosts are passed unchecked as in a direct
+// dial. Blocking private destinations reliably is left to the proxy.
+func guardedProxy(proxy func(*http.Request) (*url.URL, error), policy Policy) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		proxyURL, err := proxy(req)
+		if err != nil || proxyURL == nil {
+			return proxyURL, err
+		}
+		host := req.URL.Hostname()
+		if policy.hostAllowed(host) {
+			return proxyURL, nil
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			if err := policy.checkIP(host, ip); err != nil {
+				return nil, err
+			}
+			return proxyURL, nil
+		}
+		addrs, err := net.DefaultResolver.LookupIPAddr(req.Context(), host)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if err := policy.checkIP(host, addr.IP); err != nil {
+				return nil, err
+			}
+		}
+		return proxyURL, nil
+	}
+}
+
+// guardedDialContext dials through dialer, checking every resolved address
+// against the policy unless the host being dialed is explicitly allowlisted.
+func guardedDialContext(dialer *net.Dialer, policy Policy) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	guarded := *dialer
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if policy.hostAllowed(host) {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		d := guarded
+		d.Control = func(_, address string, _ syscall.RawConn) error {
+			ipStr, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(ipStr)
+			if ip == nil {
+				return &DeniedError{Host: host, Reason: fmt.Sprintf("unparseable address %q", ipStr)}
+			}
+			return policy.checkIP(host, ip)
+		}
+		return d.DialContext(ctx, network, addr)
+	}
+}
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestGuardedProxy(t *testing.T) {
+	proxyURL, _ := url.Parse("http://proxy.example:3128")
+	viaProxy := http.ProxyURL(proxyURL)
+	direct := func(*http.Request) (*url.URL, error) { return nil, nil }
+	policy := Policy{AllowedHosts: []string{"hooks.internal"}}
+
+	tests := []struct {
+		name   string
+		proxy  func(*http.Request) (*url.URL, error)
+		target string
+		want   *url.URL
+		denied bool
+	}{
+		{"public address", viaProxy, "http://93.184.216.34/hook", proxyURL, false},
+		{"private address", viaProxy, "http://10.0.0.5/hook", nil, true},
+		{"metadata address", viaProxy, "http://169.254.169.254/latest", nil, true},
+		{"host resolving to loopback", viaProxy, "http://localhost:8080/hook", nil, true},
+		{"allowlisted host", viaProxy, "https://hooks.internal/hook", proxyURL, false},
+		{"not proxied", direct, "http://10.0.0.5/hook", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, tt.target, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := guardedProxy(tt.proxy, policy)(req)
+			var denied *DeniedError
+			if errors.As(err, &denied) != tt.denied {
+				t.Fatalf("err = %v, want denied %t", err, tt.denied)
+			}
+			if !tt.denied && err != nil {
+				t.Fatalf("err = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("proxy = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
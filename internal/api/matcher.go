@@ -0,0 +1,107 @@
+package api
+
+import "strings"
+
+// Event types webhooks can subscribe to.
+const (
+	EventMessageReceived = "message.received"
+	EventMessageSent     = "message.sent"
+	EventChatClosed      = "chat.closed"
+	EventChatReopened    = "chat.reopened"
+	EventChatTransferred = "chat.transferred"
+	EventChatTabulated   = "chat.tabulated"
+)
+
+// WebhookFilter narrows a webhook's subscription. Every non-empty list must
+// contain the event's value; an empty list matches anything.
+type WebhookFilter struct {
+	Departments  []string
+	Tags         []string
+	Agents       []string
+	MessageTypes []string
+}
+
+// Matches reports whether ev should be delivered to the webhook.
+func (wh *Webhook) Matches(ev *Event) bool {
+	if !wh.Enabled {
+		return false
+	}
+	if wh.Conn != nil && ev.Instance != "" && *wh.Conn != ev.Instance && !wh.IsGlobal {
+		return false
+	}
+	if !wh.Subscribed(ev.Type) {
+		return false
+	}
+	return wh.Filter.matches(ev)
+}
+
+// Subscribed reports whether the webhook wants events of eventType. Webhooks
+// without an explicit subscription list fall back to the send_message and
+// receive_message flags for message events and get no other events, so their
+// integrations only see the payloads they were written for.
+func (wh *Webhook) Subscribed(eventType string) bool {
+	if len(wh.Events) == 0 {
+		switch eventType {
+		case EventMessageReceived:
+			return wh.ReceiveMessage
+		case EventMessageSent:
+			return wh.SendMessage
+		}
+		return false
+	}
+	for _, pattern := range wh.Events {
+		if matchEventType(pattern, eventType) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchEventType matches exact types, "*" and prefix wildcards like "chat.*".
+func matchEventType(pattern, eventType string) bool {
+	pattern = strings.TrimSpace(pattern)
+	if pattern == "*" || pattern == eventType {
+		return true
+	}
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(eventType, prefix)
+	}
+	return false
+}
+
+func (f WebhookFilter) matches(ev *Event) bool {
+	var department, agent, tag string
+	if ev.Chat != nil {
+		department, agent, tag = ev.Chat.Department, ev.Chat.Agent, ev.Chat.Tag
+	}
+	if !containsAny(f.Departments, department) {
+		return false
+	}
+	if !containsAny(f.Agents, agent) {
+		return false
+	}
+	if !containsAny(f.Tags, strings.Split(tag, ",")...) {
+		return false
+	}
+	// Events without a message, such as chat.closed, are not filtered by
+	// message type.
+	if ev.Message != nil && !containsAny(f.MessageTypes, ev.Message.Type) {
+		return false
+	}
+	return true
+}
+
+func containsAny(list []string, values ...string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, item := range list {
+		for _, value := range values {
+			value = strings.TrimSpace(value)
+			if value != "" && strings.EqualFold(item, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
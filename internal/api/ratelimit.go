@@ -0,0 +1,125 @@
+package api
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// tokenBucket allows rate events per second with bursts of up to burst.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes a token and returns how long the caller must wait before
+// using it.
+func (b *tokenBucket) reserve() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) cancel() {
+	b.mu.Lock()
+	b.tokens++
+	b.mu.Unlock()
+}
+
+// full reports whether the bucket would be back at its burst by now.
+func (b *tokenBucket) full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// wait blocks for the delay of a reserved token, handing it back if ctx is
+// done first.
+func (b *tokenBucket) wait(ctx context.Context, delay time.Duration) error {
+	if delay == 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.cancel()
+		return ctx.Err()
+	}
+}
+
+// keyedLimiter keeps one token bucket per key. A zero rate disables limiting.
+// Buckets that have refilled completely are no different from new ones, so
+// they are dropped now and then to keep the map from growing with every host
+// and instance ever seen.
+type keyedLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     int
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+const limiterSweepInterval = time.Minute
+
+func newKeyedLimiter(rate float64, burst int) *keyedLimiter {
+	return &keyedLimiter{rate: rate, burst: burst, buckets: make(map[string]*tokenBucket), lastSweep: time.Now()}
+}
+
+func (l *keyedLimiter) Wait(ctx context.Context, key string) error {
+	if l == nil || l.rate <= 0 || key == "" {
+		return nil
+	}
+	// The token is taken under the map lock so a bucket can't be swept
+	// between the lookup and the reservation.
+	l.mu.Lock()
+	now := time.Now()
+	if now.Sub(l.lastSweep) >= limiterSweepInterval {
+		l.sweep(now)
+	}
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = newTokenBucket(l.rate, l.burst)
+		l.buckets[key] = bucket
+	}
+	delay := bucket.reserve()
+	l.mu.Unlock()
+	return bucket.wait(ctx, delay)
+}
+
+// sweep drops the buckets that are full again. l.mu must be held.
+func (l *keyedLimiter) sweep(now time.Time) {
+	for key, bucket := range l.buckets {
+		if bucket.full(now) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
@@ -1,47 +1,70 @@
 package api
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
 	"wasolgo/internal/parser"
 )
 
-func SendRequest(req *parser.Request) error {
+// SendRequest sends req and returns the captured response. Non-2xx responses
+// are returned together with a *StatusError.
+func SendRequest(req *parser.Request) (*Response, error) {
 	if req.Url == "" {
-		return fmt.Errorf("request url is empty. cannot send http request")
+		return nil, fmt.Errorf("request url is empty. cannot send http request")
 	}
 
-	jsonBody, err := json.Marshal(req.Body)
+	requestURL, err := buildURL(req.Url, req.Params)
 	if err != nil {
-		fmt.Printf("Error when marshalling the json: %v", err)
-		return err
+		fmt.Printf("Error when building the request url: %v", err)
+		return nil, err
 	}
 
-	httpReq, err := http.NewRequest(req.Method, req.Url, bytes.NewBuffer(jsonBody))
+	body, contentType, err := buildBody(req)
+	if err != nil {
+		fmt.Printf("Error when encoding the request body: %v", err)
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequest(req.Method, requestURL, body)
 	if err != nil {
 		fmt.Printf("Error when creating the HTTP request: %v", err)
-		return err
+		return nil, err
 	}
 
 	for key, value := range req.Headers {
 		httpReq.Header.Set(key, value)
 	}
+	if httpReq.Header.Get("Content-Type") == "" || strings.EqualFold(req.BodyType, parser.BodyTypeMultipart) {
+		httpReq.Header.Set("Content-Type", contentType)
+	}
 
-	client := &http.Client{}
-	resp, err := client.Do(httpReq)
+	instance := req.Instance
+	if instance == "" {
+		instance = evolutionInstance(httpReq.URL)
+	}
+	resp, err := do(httpReq, instance)
 	if err != nil {
 		fmt.Printf("Error when sending the HTTP request: %v", err)
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		fmt.Printf("Request failed with status: %s", resp.Status)
-		return nil
+	response, err := readResponse(resp)
+	if err != nil {
+		fmt.Printf("Error when reading the HTTP response: %v", err)
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		fmt.Printf("Request failed with status: %s, headers: %v, body: %s", resp.Status, resp.Header, response.Body)
+		return response, &StatusError{
+			Response:   response,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
 	}
 
-	fmt.Printf("Request was successfull with status: %s", resp.Status)
-	return nil
+	fmt.Printf("Request was successfull with status: %s, body: %s", resp.Status, response.Body)
+	return response, nil
 }
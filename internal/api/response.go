@@ -0,0 +1,74 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const maxResponseBody = 1 << 20
+
+type Response struct {
+	StatusCode int         `json:"status_code"`
+	Status     string      `json:"status"`
+	Headers    http.Header `json:"headers"`
+	Body       string      `json:"body"`
+}
+
+// StatusError is returned when the upstream answers with a non-2xx status.
+type StatusError struct {
+	Response   *Response
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("request failed with status %s", e.Response.Status)
+}
+
+// Retryable reports whether the request may succeed if sent again: 429 and
+// 5xx are retryable, every other status is a permanent failure.
+func (e *StatusError) Retryable() bool {
+	return e.Response.StatusCode == http.StatusTooManyRequests || e.Response.StatusCode >= 500
+}
+
+// RetryDelay reports whether err is retryable and how long the upstream asked
+// us to wait before retrying. A zero delay means no Retry-After was given.
+func RetryDelay(err error) (time.Duration, bool) {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.Retryable() {
+		return statusErr.RetryAfter, true
+	}
+	return 0, false
+}
+
+func readResponse(resp *http.Response) (*Response, error) {
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseBody))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read response body: %w", err)
+	}
+	return &Response{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Headers:    resp.Header,
+		Body:       string(body),
+	}, nil
+}
+
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	HeaderEventID   = "X-WaSol-Event-Id"
+	HeaderTimestamp = "X-WaSol-Timestamp"
+	HeaderSignature = "X-WaSol-Signature"
+)
+
+// Sign computes the v1 signature: hex HMAC-SHA256 of "<timestamp>.<body>".
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignatureHeader builds the X-WaSol-Signature value with one v1 entry per
+// non-empty secret, so receivers keep verifying while a secret is rotated.
+func SignatureHeader(timestamp int64, body []byte, secrets ...string) string {
+	var parts []string
+	for _, secret := range secrets {
+		if secret != "" {
+			parts = append(parts, "v1="+Sign(secret, timestamp, body))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// VerifySignature checks a signature header the way a receiver should: the
+// timestamp must be within tolerance of now and any v1 entry must match.
+func VerifySignature(secret, header, timestamp string, body []byte, tolerance time.Duration, now time.Time) error {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp: %w", err)
+	}
+	if age := now.Sub(time.Unix(ts, 0)); age > tolerance || age < -tolerance {
+		return fmt.Errorf("timestamp outside tolerance")
+	}
+	expected := Sign(secret, ts, body)
+	for _, part := range strings.Split(header, ",") {
+		if sig, ok := strings.CutPrefix(strings.TrimSpace(part), "v1="); ok {
+			if hmac.Equal([]byte(sig), []byte(expected)) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no matching signature")
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+// WebhookAuth is the auth config of a webhook, stored as JSON:
+// {"type": "bearer", "token": "..."}, {"type": "basic", "username": "...",
+// "password": "..."} or {"type": "header", "name": "...", "value": "..."}.
+type WebhookAuth struct {
+	Type     string `json:"type"`
+	Token    string `json:"token,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Value    string `json:"value,omitempty"`
+}
+
+func (a *WebhookAuth) validate() error {
+	switch strings.ToLower(a.Type) {
+	case "bearer":
+		if a.Token == "" {
+			return fmt.Errorf("bearer auth requires token")
+		}
+	case "basic":
+		if a.Username == "" {
+			return fmt.Errorf("basic auth requires username")
+		}
+	case "header":
+		if a.Name == "" {
+			return fmt.Errorf("header auth requires name")
+		}
+	default:
+		return fmt.Errorf("unknown auth type %q", a.Type)
+	}
+	return nil
+}
+
+func (a *WebhookAuth) apply(req *http.Request) {
+	switch strings.ToLower(a.Type) {
+	case "bearer":
+		req.Header.Set("Authorization", "Bearer "+a.Token)
+	case "basic":
+		req.SetBasicAuth(a.Username, a.Password)
+	case "header":
+		req.Header.Set(a.Name, a.Value)
+	}
+}
+
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// Compile validates the webhook's auth config and parses its body template.
+// A webhook that fails to compile still matches events, but its deliveries
+// fail with the compile error instead of being sent.
+func (wh *Webhook) Compile() error {
+	wh.template = nil
+	wh.compileErr = nil
+	if wh.Auth != nil {
+		if err := wh.Auth.validate(); err != nil {
+			wh.compileErr = fmt.Errorf("webhook %d: invalid auth: %w", wh.ID, err)
+			return wh.compileErr
+		}
+	}
+	if strings.TrimSpace(wh.BodyTemplate) == "" {
+		return nil
+	}
+	tmpl, err := template.New(fmt.Sprintf("webhook-%d", wh.ID)).Funcs(templateFuncs).Option("missingkey=zero").Parse(wh.BodyTemplate)
+	if err != nil {
+		wh.compileErr = fmt.Errorf("webhook %d: invalid body template: %w", wh.ID, err)
+		return wh.compileErr
+	}
+	wh.template = tmpl
+	return nil
+}
+
+// renderTemplate executes the body template against the event. The Content-
+// Type defaults to application/json unless set in the webhook's headers.
+func (wh *Webhook) renderTemplate(ev *Event) ([]byte, string, error) {
+	// Templates see every section of the event, empty when the event has
+	// none, so {{.Customer.Name}} renders instead of failing on nil.
+	data := *ev
+	if data.Chat == nil {
+		data.Chat = &EventChat{}
+	}
+	if data.Customer == nil {
+		data.Customer = &EventCustomer{}
+	}
+	if data.Message == nil {
+		data.Message = &EventMessage{}
+	}
+	if data.Message.Media == nil {
+		msg := *data.Message
+		msg.Media = &EventMedia{}
+		data.Message = &msg
+	}
+	var buf bytes.Buffer
+	if err := wh.template.Execute(&buf, &data); err != nil {
+		return nil, "", fmt.Errorf("webhook %d: couldn't render body template: %w", wh.ID, err)
+	}
+	contentType := "application/json"
+	for key, value := range wh.Headers {
+		if strings.EqualFold(key, "Content-Type") {
+			contentType = value
+		}
+	}
+	return buf.Bytes(), contentType, nil
+}
@@ -2,9 +2,12 @@ package api
 
 import (
 	"bytes"
-	"encoding/json"
-	"fmt"
+	"crypto/rand"
+	"encoding/hex"
 	"net/http"
+	"strconv"
+	"text/template"
+	"time"
 )
 
 type Webhook struct {
@@ -15,30 +18,81 @@ type Webhook struct {
 	Conn           *string
 	SendMessage    bool
 	ReceiveMessage bool
+	Enabled        bool
+	// Secret and SecondarySecret sign every delivery. Both are active at
+	// the same time so a secret can be rotated without downtime.
+	Secret          string
+	SecondarySecret string
+	Format          string
+	// Events lists subscribed event types; empty keeps the legacy
+	// send_message/receive_message behaviour.
+	Events []string
+	Filter WebhookFilter
+	// Headers are added to every delivery; Auth and the signature headers
+	// take precedence over them.
+	Headers      map[string]string
+	Auth         *WebhookAuth
+	BodyTemplate string
+
+	template   *template.Template
+	compileErr error
 }
 
 type WebhookMessage struct {
-	Conn       string `json:"conn"`
-	Message    string `json:"message"`
-	SentBy     string `json:"sent_by"`
-	Department string `json:"department"`
-	Agent      string `json:"agent"`
-	Tag        string `json:"tag"`
-	IsOpen     bool   `json:"is_open"`
+	Event       string `json:"event,omitempty"`
+	ChatID      string `json:"chat_id,omitempty"`
+	PerformedBy string `json:"performed_by,omitempty"`
+	Conn        string `json:"conn"`
+	Message     string `json:"message"`
+	SentBy      string `json:"sent_by"`
+	Department  string `json:"department"`
+	Agent       string `json:"agent"`
+	Tag         string `json:"tag"`
+	IsOpen      bool   `json:"is_open"`
 }
 
-func SendWebhook(url string, msg *WebhookMessage) error {
-	body, err := json.Marshal(msg)
+// SendWebhook posts an already encoded payload to the webhook, signed with its
+// secrets. Non-2xx responses are returned together with a *StatusError.
+func SendWebhook(wh *Webhook, eventID, contentType string, body []byte) (*Response, error) {
+	req, err := http.NewRequest(http.MethodPost, wh.Url, bytes.NewReader(body))
 	if err != nil {
-		return err
+		return nil, err
+	}
+	timestamp := time.Now().Unix()
+	for key, value := range wh.Headers {
+		req.Header.Set(key, value)
+	}
+	if wh.Auth != nil {
+		wh.Auth.apply(req)
 	}
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(HeaderEventID, eventID)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	if signature := SignatureHeader(timestamp, body, wh.Secret, wh.SecondarySecret); signature != "" {
+		req.Header.Set(HeaderSignature, signature)
+	}
+	resp, err := do(req, "")
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
+	response, err := readResponse(resp)
+	if err != nil {
+		return nil, err
+	}
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("webhook returned status %s", resp.Status)
+		return response, &StatusError{
+			Response:   response,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
+	}
+	return response, nil
+}
+
+func NewEventID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
 	}
-	return nil
+	return hex.EncodeToString(b)
 }
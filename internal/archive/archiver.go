@@ -0,0 +1,276 @@
+// Package archive keeps the Redis message lists bounded. Messages older than
+// the retention window are copied to Postgres and then trimmed from Redis,
+// and History reads a chat's messages across both.
+package archive
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"wasolgo/internal/chatstore"
+	"wasolgo/internal/database"
+	redis "wasolgo/internal/redis"
+
+	rdb "github.com/redis/go-redis/v9"
+)
+
+type Config struct {
+	Interval time.Duration
+	// KeepMessages is the number of most recent messages kept in Redis per
+	// chat. Zero doesn't limit by count.
+	KeepMessages int64
+	// KeepFor keeps messages newer than this in Redis. Zero doesn't limit by
+	// age. With both limits set, a message is kept while either keeps it.
+	KeepFor time.Duration
+	// FinishedGrace drops chats from Redis once they have been finished this
+	// long. Zero keeps finished chats.
+	FinishedGrace time.Duration
+	// BatchSize caps the messages archived per chat in one pass.
+	BatchSize int64
+	// LockTTL bounds how long a crashed archiver holds a chat.
+	LockTTL time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Interval:  10 * time.Minute,
+		BatchSize: 1000,
+		LockTTL:   time.Minute,
+	}
+}
+
+// Enabled reports whether any retention limit is set.
+func (c Config) Enabled() bool {
+	return c.KeepMessages > 0 || c.KeepFor > 0 || c.FinishedGrace > 0
+}
+
+type Archiver struct {
+	db  *sql.DB
+	rdb *rdb.Client
+	cfg Config
+}
+
+func NewArchiver(db *sql.DB, client *rdb.Client, cfg Config) *Archiver {
+	def := DefaultConfig()
+	if cfg.Interval <= 0 {
+		cfg.Interval = def.Interval
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = def.BatchSize
+	}
+	if cfg.LockTTL <= 0 {
+		cfg.LockTTL = def.LockTTL
+	}
+	return &Archiver{db: db, rdb: client, cfg: cfg}
+}
+
+func (a *Archiver) Run(ctx context.Context) {
+	log.Print("Message archiver started")
+	ticker := time.NewTicker(a.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		a.archiveAll(ctx)
+		select {
+		case <-ctx.Done():
+			log.Print("Message archiver stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *Archiver) archiveAll(ctx context.Context) {
+	var archived, dropped, failed int64
+	iter := a.rdb.SScan(ctx, "chats", 0, "", 500).Iterator()
+	for iter.Next(ctx) {
+		chatID := iter.Val()
+		n, drop, err := a.archiveChat(ctx, chatID)
+		if err != nil {
+			log.Printf("[archive] chat %s: %v", chatID, err)
+			failed++
+			continue
+		}
+		archived += n
+		if drop {
+			dropped++
+		}
+	}
+	if err := iter.Err(); err != nil && ctx.Err() == nil {
+		log.Printf("[archive] %v", err)
+	}
+	if archived > 0 || dropped > 0 || failed > 0 {
+		log.Printf("[archive] Archived %d messages, dropped %d finished chats, %d chats failed", archived, dropped, failed)
+	}
+}
+
+// archiveChat archives the messages of one chat that fall outside the
+// retention window, and drops the chat when it has been finished for longer
+// than the grace period. Only one archiver works on a chat at a time, since
+// two trimming the same head would lose the messages in between. chatID is the
+// stored ID and every key is addressed by it: resolving it could land on a
+// duplicate variant chat, whose messages would be archived under this ID
+// while this chat's list is trimmed.
+func (a *Archiver) archiveChat(ctx context.Context, chatID string) (int64, bool, error) {
+	unlock, err := Lock(ctx, a.rdb, chatID, a.cfg.LockTTL)
+	if err != nil || unlock == nil {
+		return 0, false, err
+	}
+	defer unlock()
+
+	header, err := redis.StoredChat(ctx, a.rdb, chatID)
+	if err != nil {
+		if errors.Is(err, rdb.Nil) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	length, _, err := redis.StoredCounts(ctx, a.rdb, chatID)
+	if err != nil {
+		return 0, false, err
+	}
+
+	drop := a.expired(header, time.Now())
+	n := length
+	if !drop {
+		if n, err = a.outsideWindow(ctx, chatID, length); err != nil {
+			return 0, false, err
+		}
+	}
+	if n > a.cfg.BatchSize {
+		n, drop = a.cfg.BatchSize, false
+	}
+	if n > 0 {
+		if err := a.archive(ctx, chatID, n); err != nil {
+			return 0, false, err
+		}
+	}
+	if !drop {
+		return n, false, nil
+	}
+	dropped, err := redis.DropChat(ctx, a.rdb, chatID, func(header map[string]interface{}) bool {
+		return a.expired(header, time.Now())
+	})
+	return n, dropped, err
+}
+
+// Lock takes the archiver's lock on a chat for ttl, so other work that
+// renumbers its messages can keep the archiver off it. It returns nil when
+// the chat is already locked, and otherwise the function releasing the lock.
+func Lock(ctx context.Context, client *rdb.Client, chatID string, ttl time.Duration) (func(), error) {
+	lockKey := "archiver:lock:" + chatID
+	token := lockToken()
+	locked, err := client.SetNX(ctx, lockKey, token, ttl).Result()
+	if err != nil || !locked {
+		return nil, err
+	}
+	return func() {
+		unlockScript.Run(context.Background(), client, []string{lockKey}, token)
+	}, nil
+}
+
+// unlockScript deletes the lock only while it holds the caller's token, so an
+// archiver whose lock expired doesn't release the next holder's.
+var unlockScript = rdb.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+func lockToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// archive copies the n oldest messages of the chat to Postgres and trims
+// them from Redis once they are all there.
+func (a *Archiver) archive(ctx context.Context, chatID string, n int64) error {
+	_, offset, err := redis.StoredCounts(ctx, a.rdb, chatID)
+	if err != nil {
+		return err
+	}
+	messages, err := redis.StoredMessages(ctx, a.rdb, chatID, 0, n-1)
+	if err != nil {
+		return err
+	}
+	n = int64(len(messages))
+	if n == 0 {
+		return nil
+	}
+	if err := database.ArchiveMessages(a.db, chatID, offset, messages); err != nil {
+		return err
+	}
+	stored, err := database.CountArchivedMessages(a.db, chatID, offset, offset+n)
+	if err != nil {
+		return err
+	}
+	if stored != n {
+		return fmt.Errorf("only %d of %d messages at %d are archived, not trimming", stored, n, offset)
+	}
+	return redis.TrimMessages(ctx, a.rdb, chatID, n)
+}
+
+// outsideWindow returns how many of the oldest messages the retention limits
+// no longer keep.
+func (a *Archiver) outsideWindow(ctx context.Context, chatID string, length int64) (int64, error) {
+	if a.cfg.KeepMessages <= 0 && a.cfg.KeepFor <= 0 {
+		return 0, nil
+	}
+	n := length
+	if a.cfg.KeepMessages > 0 {
+		n = length - a.cfg.KeepMessages
+	}
+	if n <= 0 || a.cfg.KeepFor <= 0 {
+		return max(n, 0), nil
+	}
+
+	if n > a.cfg.BatchSize {
+		n = a.cfg.BatchSize
+	}
+	messages, err := redis.StoredMessages(ctx, a.rdb, chatID, 0, n-1)
+	if err != nil {
+		return 0, err
+	}
+	// A message without a timestamp was stored before the next one that has
+	// one, so it goes with that one; trailing ones are kept until a later
+	// message dates them.
+	cutoff := time.Now().Add(-a.cfg.KeepFor)
+	var old, undated int64
+	for _, raw := range messages {
+		at, ok := redis.MessageTime(raw)
+		if !ok {
+			undated++
+			continue
+		}
+		if !at.Before(cutoff) {
+			break
+		}
+		old += undated + 1
+		undated = 0
+	}
+	return old, nil
+}
+
+// expired reports whether the chat was finished longer than the grace period
+// ago.
+func (a *Archiver) expired(header map[string]interface{}, now time.Time) bool {
+	if a.cfg.FinishedGrace <= 0 || chatstore.Situation(header) != chatstore.SituationFinished {
+		return false
+	}
+	for _, field := range []string{"finished_at", "closed_at", "situation_changed_at"} {
+		value, _ := header[field].(string)
+		if at, err := time.Parse(time.RFC3339, value); err == nil {
+			return now.Sub(at) > a.cfg.FinishedGrace
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package archive
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/lib/pq"
+	rdb "github.com/redis/go-redis/v9"
+)
+
+// TestArchiveChatDuplicateVariants archives a legacy 8-digit chat whose alias
+// points at its 9-digit duplicate: only the legacy chat's own messages may be
+// archived and trimmed.
+func TestArchiveChatDuplicateVariants(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	client := rdb.NewClient(&rdb.Options{Addr: mr.Addr()})
+	defer client.Close()
+
+	const (
+		legacy = "551187654321@s.whatsapp.net"
+		target = "5511987654321@s.whatsapp.net"
+	)
+	for id, messages := range map[string][]string{
+		legacy: {"a1", "a2", "a3"},
+		target: {"b1", "b2"},
+	} {
+		mr.Lpush("chat:"+id, `{"id":"`+id+`","situation":"in_progress","is_active":true}`)
+		for _, m := range messages {
+			mr.Push("chat:"+id+":messages", m)
+		}
+		mr.SetAdd("chats", id)
+	}
+	mr.Set("chat_alias:"+legacy, target)
+	mr.Set("chat:"+target+":archived", "7")
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	archived, _ := pq.Array([]string{"a1", "a2"}).Value()
+	mock.ExpectExec("INSERT INTO chat_message_archive").
+		WithArgs(legacy, int64(0), archived).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectQuery("SELECT COUNT").
+		WithArgs(legacy, int64(0), int64(2)).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+
+	a := NewArchiver(db, client, Config{KeepMessages: 1})
+	n, dropped, err := a.archiveChat(ctx, legacy)
+	if err != nil {
+		t.Fatalf("archiveChat: %v", err)
+	}
+	if n != 2 || dropped {
+		t.Errorf("archiveChat = %d, %t, want 2, false", n, dropped)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	if got, _ := mr.List("chat:" + legacy + ":messages"); len(got) != 1 || got[0] != "a3" {
+		t.Errorf("legacy messages = %v, want [a3]", got)
+	}
+	if got, _ := mr.Get("chat:" + legacy + ":archived"); got != "2" {
+		t.Errorf("legacy archived = %q, want 2", got)
+	}
+	if got, _ := mr.List("chat:" + target + ":messages"); len(got) != 2 {
+		t.Errorf("target messages = %v, want untouched", got)
+	}
+	if got, _ := mr.Get("chat:" + target + ":archived"); got != "7" {
+		t.Errorf("target archived = %q, want untouched", got)
+	}
+	if mr.Exists("archiver:lock:" + legacy) {
+		t.Error("lock was not released")
+	}
+}
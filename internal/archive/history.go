@@ -0,0 +1,75 @@
+package archive
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"wasolgo/internal/chatstore"
+	"wasolgo/internal/database"
+)
+
+type HistoryPage struct {
+	ChatID string `json:"chat_id"`
+	// First is the position of Messages[0] in the chat's history; pass it as
+	// before to fetch the previous page.
+	First    int64             `json:"first"`
+	Total    int64             `json:"total"`
+	Messages []json.RawMessage `json:"messages"`
+}
+
+// History returns up to limit messages of the chat before position before,
+// oldest first, reading archived messages from Postgres and the rest from
+// the store. A negative before reads the most recent messages.
+func History(ctx context.Context, db *sql.DB, store chatstore.Store, chatID string, before, limit int64) (*HistoryPage, error) {
+	id, found, err := store.FindChat(ctx, chatID)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		// Dropped chats keep their archived history under their stored ID.
+		if id, err = store.ResolveChatID(ctx, chatID); err != nil {
+			return nil, err
+		}
+	}
+	archived, err := store.ArchivedCount(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	var length int64
+	if found {
+		if length, err = store.CountMessages(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+
+	page := &HistoryPage{ChatID: id, Total: archived + length, Messages: []json.RawMessage{}}
+	if before < 0 || before > page.Total {
+		before = page.Total
+	}
+	page.First = max(before-limit, 0)
+
+	var messages []string
+	if page.First < archived {
+		older, err := database.ArchivedMessages(db, id, page.First, min(before, archived))
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, older...)
+	}
+	if before > archived {
+		recent, err := store.ListMessages(ctx, id, max(page.First, archived)-archived, before-archived-1)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, recent...)
+	}
+	for _, m := range messages {
+		if !json.Valid([]byte(m)) {
+			b, _ := json.Marshal(m)
+			m = string(b)
+		}
+		page.Messages = append(page.Messages, json.RawMessage(m))
+	}
+	return page, nil
+}
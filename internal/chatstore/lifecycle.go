@@ -0,0 +1,291 @@
+package chatstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	redis "wasolgo/internal/redis"
+)
+
+// Chat situations. A chat waits in its department's queue until an agent is
+// assigned, is in progress while the customer waits for the agent, waits for
+// the customer once the agent has replied, and is finished when closed.
+const (
+	SituationEnqueued        = "enqueued"
+	SituationAssigned        = "assigned"
+	SituationInProgress      = "in_progress"
+	SituationWaitingCustomer = "waiting_customer"
+	SituationFinished        = "finished"
+)
+
+var transitions = map[string][]string{
+	SituationEnqueued:        {SituationEnqueued, SituationAssigned, SituationFinished},
+	SituationAssigned:        {SituationEnqueued, SituationAssigned, SituationInProgress, SituationWaitingCustomer, SituationFinished},
+	SituationInProgress:      {SituationEnqueued, SituationAssigned, SituationWaitingCustomer, SituationFinished},
+	SituationWaitingCustomer: {SituationEnqueued, SituationAssigned, SituationInProgress, SituationFinished},
+	SituationFinished:        {SituationEnqueued, SituationAssigned},
+}
+
+// Reopen policies, applied when a finished chat receives a customer message.
+const (
+	// ReopenRequeue puts the chat back in the default department's queue
+	// with agent, tags and tabulation cleared.
+	ReopenRequeue = "requeue"
+	// ReopenSameDepartment queues the chat in the department it was closed
+	// in.
+	ReopenSameDepartment = "same_department"
+	// ReopenSameAgent assigns the chat back to the agent that closed it, and
+	// falls back to same_department when there was none.
+	ReopenSameAgent = "same_agent"
+)
+
+// LifecycleConfig sets how finished chats are reopened.
+type LifecycleConfig struct {
+	DefaultDepartment string
+	ReopenPolicy      string
+	// DepartmentPolicies overrides ReopenPolicy by the department the chat
+	// was finished in.
+	DepartmentPolicies map[string]string
+}
+
+var lifecycle = LifecycleConfig{
+	DefaultDepartment: "aguardando_colaborador",
+	ReopenPolicy:      ReopenRequeue,
+}
+
+// ConfigureLifecycle replaces the lifecycle configuration. Empty values keep
+// their defaults.
+func ConfigureLifecycle(cfg LifecycleConfig) error {
+	if cfg.DefaultDepartment == "" {
+		cfg.DefaultDepartment = lifecycle.DefaultDepartment
+	}
+	if cfg.ReopenPolicy == "" {
+		cfg.ReopenPolicy = ReopenRequeue
+	}
+	if err := checkReopenPolicy(cfg.ReopenPolicy); err != nil {
+		return err
+	}
+	for department, policy := range cfg.DepartmentPolicies {
+		if err := checkReopenPolicy(policy); err != nil {
+			return fmt.Errorf("department %s: %w", department, err)
+		}
+	}
+	lifecycle = cfg
+	return nil
+}
+
+func checkReopenPolicy(policy string) error {
+	switch policy {
+	case ReopenRequeue, ReopenSameDepartment, ReopenSameAgent:
+		return nil
+	}
+	return fmt.Errorf("unknown reopen policy %q", policy)
+}
+
+// ParseReopenPolicies reads department:policy pairs.
+func ParseReopenPolicies(pairs []string) (map[string]string, error) {
+	policies := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		department, policy, ok := strings.Cut(pair, ":")
+		if !ok || department == "" {
+			return nil, fmt.Errorf("invalid reopen policy %q, expected department:policy", pair)
+		}
+		policies[department] = policy
+	}
+	return policies, nil
+}
+
+// TransitionError is returned for a transition the lifecycle doesn't allow.
+type TransitionError struct {
+	From, To string
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("chat can't go from %s to %s", e.From, e.To)
+}
+
+// CanTransition reports whether a chat may go from one situation to another.
+// Situations written before the lifecycle existed may go anywhere.
+func CanTransition(from, to string) bool {
+	allowed, known := transitions[from]
+	if !known {
+		return true
+	}
+	for _, situation := range allowed {
+		if situation == to {
+			return true
+		}
+	}
+	return false
+}
+
+// TransitionFields returns the header fields that move a chat from one
+// situation to another, stamping the time it entered the new situation.
+func TransitionFields(from, to string, now time.Time) (map[string]interface{}, error) {
+	if _, known := transitions[to]; !known {
+		return nil, fmt.Errorf("unknown chat situation %q", to)
+	}
+	if !CanTransition(from, to) {
+		return nil, &TransitionError{From: from, To: to}
+	}
+	at := now.UTC().Format(time.RFC3339)
+	return map[string]interface{}{
+		"situation":            to,
+		"is_active":            to != SituationFinished,
+		to + "_at":             at,
+		"situation_changed_at": at,
+	}, nil
+}
+
+// Situation returns the situation of a chat header, treating inactive chats
+// as finished.
+func Situation(header map[string]interface{}) string {
+	return redis.Situation(header)
+}
+
+// Change is a situation change applied to a chat header.
+type Change struct {
+	From, To string
+	// Fields are the header fields written, including the situation.
+	Fields map[string]interface{}
+}
+
+// Reopened reports whether the change reopened a finished chat.
+func (c *Change) Reopened() bool {
+	return c != nil && c.From == SituationFinished && c.To != SituationFinished
+}
+
+// Transition moves the chat to situation, merging fields into the header. The
+// transition is checked against the header it is applied to, so concurrent
+// changes can't both pass the check. It returns the header as it was before
+// and the fields written.
+func Transition(ctx context.Context, store Store, chatID, situation string, fields map[string]interface{}) (map[string]interface{}, map[string]interface{}, error) {
+	return store.ModifyChat(ctx, chatID, func(header map[string]interface{}) (map[string]interface{}, error) {
+		update, err := TransitionFields(Situation(header), situation, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range fields {
+			update[k] = v
+		}
+		return update, nil
+	})
+}
+
+// Revert undoes an update that wrote fields over previous, for when a write
+// depending on it fails. Only those fields are restored, and only while they
+// still hold the value written, so changes made to the chat meanwhile, such
+// as a new message, are kept.
+func Revert(ctx context.Context, store Store, chatID string, previous, fields map[string]interface{}) error {
+	written, err := copyHeader(fields)
+	if err != nil {
+		return err
+	}
+	_, _, err = store.ModifyChat(ctx, chatID, func(header map[string]interface{}) (map[string]interface{}, error) {
+		restore := map[string]interface{}{}
+		for k, v := range written {
+			if reflect.DeepEqual(header[k], v) {
+				restore[k] = previous[k]
+			}
+		}
+		return restore, nil
+	})
+	return err
+}
+
+// move applies the situation change next picks for the current header, if
+// any.
+func move(ctx context.Context, store Store, chatID string, next func(header map[string]interface{}, now time.Time) map[string]interface{}) (*Change, error) {
+	previous, fields, err := store.ModifyChat(ctx, chatID, func(header map[string]interface{}) (map[string]interface{}, error) {
+		return next(header, time.Now()), nil
+	})
+	if err != nil || len(fields) == 0 {
+		return nil, err
+	}
+	to, _ := fields["situation"].(string)
+	return &Change{From: Situation(previous), To: to, Fields: fields}, nil
+}
+
+// reopenFields returns the header update for a finished chat receiving a
+// customer message, following the policy of the department it was finished
+// in.
+func reopenFields(header map[string]interface{}, now time.Time) map[string]interface{} {
+	department, _ := header["department"].(string)
+	agentID, _ := header["agent_id"].(string)
+	policy, ok := lifecycle.DepartmentPolicies[department]
+	if !ok {
+		policy = lifecycle.ReopenPolicy
+	}
+
+	to := SituationEnqueued
+	fields := map[string]interface{}{}
+	switch policy {
+	case ReopenSameAgent:
+		if agentID != "" {
+			to = SituationAssigned
+			break
+		}
+		fields["agent_id"] = nil
+	case ReopenSameDepartment:
+		fields["agent_id"] = nil
+	default:
+		fields["department"] = lifecycle.DefaultDepartment
+		fields["agent_id"] = nil
+		fields["tags"] = nil
+	}
+	if department == "" {
+		fields["department"] = lifecycle.DefaultDepartment
+	}
+	fields["tabulation"] = nil
+
+	update, _ := TransitionFields(SituationFinished, to, now)
+	for k, v := range fields {
+		update[k] = v
+	}
+	update["reopened_at"] = update["situation_changed_at"]
+	return update
+}
+
+// CustomerMessage moves a chat on a customer message: a finished chat is
+// reopened and a chat waiting for the customer is back in progress. It
+// returns the change made, or nil when the situation stays. Chats not yet in
+// the store are left to be created.
+func CustomerMessage(ctx context.Context, store Store, chatID string) (*Change, error) {
+	change, err := move(ctx, store, chatID, func(header map[string]interface{}, now time.Time) map[string]interface{} {
+		switch Situation(header) {
+		case SituationFinished:
+			return reopenFields(header, now)
+		case SituationWaitingCustomer:
+			update, _ := TransitionFields(SituationWaitingCustomer, SituationInProgress, now)
+			return update
+		}
+		return nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	return change, err
+}
+
+// AgentMessage moves an assigned or in-progress chat to waiting for the
+// customer once the agent has replied. It returns the change made, or nil
+// when the situation stays. Chats missing from the store are left as they
+// are.
+func AgentMessage(ctx context.Context, store Store, chatID string) (*Change, error) {
+	change, err := move(ctx, store, chatID, func(header map[string]interface{}, now time.Time) map[string]interface{} {
+		switch from := Situation(header); from {
+		case SituationAssigned, SituationInProgress:
+			update, _ := TransitionFields(from, SituationWaitingCustomer, now)
+			return update
+		}
+		return nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	return change, err
+}
@@ -0,0 +1,48 @@
+package chatstore
+
+import (
+	"context"
+	"testing"
+)
+
+// TestRevertKeepsConcurrentChanges reverts a transfer after a message arrived
+// on the chat: the transfer's fields go back, the message's stay.
+func TestRevertKeepsConcurrentChanges(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemory()
+	const chatID = "5511987654321@s.whatsapp.net"
+	header := map[string]interface{}{"id": chatID, "situation": SituationAssigned, "is_active": true, "agent_id": "agent-1"}
+	if _, _, err := store.EnsureChat(ctx, chatID, header); err != nil {
+		t.Fatal(err)
+	}
+
+	agent := "agent-2"
+	previous, written, err := Transition(ctx, store, chatID, SituationAssigned, map[string]interface{}{"agent_id": &agent})
+	if err != nil {
+		t.Fatalf("Transition: %v", err)
+	}
+	if _, err := store.UpdateChat(ctx, chatID, map[string]interface{}{"unread": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Revert(ctx, store, chatID, previous, written); err != nil {
+		t.Fatalf("Revert: %v", err)
+	}
+
+	got, err := store.GetChat(ctx, chatID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["agent_id"] != "agent-1" {
+		t.Errorf("agent_id = %v, want agent-1", got["agent_id"])
+	}
+	if got["unread"] != float64(1) {
+		t.Errorf("unread = %v, want the concurrent 1", got["unread"])
+	}
+}
+
+func TestAgentMessageMissingChat(t *testing.T) {
+	change, err := AgentMessage(context.Background(), NewMemory(), "5511987654321@s.whatsapp.net")
+	if change != nil || err != nil {
+		t.Errorf("AgentMessage = %v, %v, want nil, nil", change, err)
+	}
+}
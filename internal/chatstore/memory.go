@@ -0,0 +1,224 @@
+package chatstore
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	redis "wasolgo/internal/redis"
+)
+
+// Memory is a Store kept in process memory. Headers are copied through JSON
+// on the way in and out so callers see the same value types as with Redis.
+type Memory struct {
+	mu       sync.Mutex
+	chats    map[string]map[string]interface{}
+	messages map[string][]string
+	activity map[string]time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		chats:    make(map[string]map[string]interface{}),
+		messages: make(map[string][]string),
+		activity: make(map[string]time.Time),
+	}
+}
+
+func (m *Memory) FindChat(ctx context.Context, chatID string) (string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, found := m.find(chatID)
+	return id, found, nil
+}
+
+// ResolveChatID falls back to the canonical ID; the memory store never drops
+// chats.
+func (m *Memory) ResolveChatID(ctx context.Context, chatID string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if id, found := m.find(chatID); found {
+		return id, nil
+	}
+	return redis.NormalizeChatID(chatID), nil
+}
+
+func (m *Memory) EnsureChat(ctx context.Context, chatID string, header map[string]interface{}) (string, bool, error) {
+	return m.AppendMessage(ctx, chatID, "", false, header)
+}
+
+func (m *Memory) AppendMessage(ctx context.Context, chatID, messageJSON string, inbound bool, header map[string]interface{}) (string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, found := m.find(chatID)
+	if !found {
+		id = redis.NormalizeChatID(chatID)
+		if len(header) == 0 {
+			header = map[string]interface{}{"id": id}
+		}
+		chatObj, err := copyHeader(header)
+		if err != nil {
+			return "", false, err
+		}
+		m.chats[id] = chatObj
+	}
+	if messageJSON != "" {
+		m.messages[id] = append(m.messages[id], messageJSON)
+		now := time.Now()
+		chatObj := m.chats[id]
+		preview, _ := copyHeader(redis.MessagePreview(messageJSON, inbound, now))
+		chatObj["last_message"] = preview
+		chatObj["last_activity_at"] = now.UTC().Format(time.RFC3339)
+		if inbound {
+			unread, _ := chatObj["unread"].(float64)
+			chatObj["unread"] = unread + 1
+		}
+		m.activity[id] = now
+	}
+	return id, !found, nil
+}
+
+func (m *Memory) UpdateChat(ctx context.Context, chatID string, fields map[string]interface{}) (map[string]interface{}, error) {
+	previous, _, err := m.ModifyChat(ctx, chatID, func(map[string]interface{}) (map[string]interface{}, error) {
+		return fields, nil
+	})
+	return previous, err
+}
+
+func (m *Memory) ModifyChat(ctx context.Context, chatID string, modify func(map[string]interface{}) (map[string]interface{}, error)) (map[string]interface{}, map[string]interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, found := m.find(chatID)
+	if !found {
+		return nil, nil, ErrNotFound
+	}
+	current := m.chats[id]
+	previous, _ := copyHeader(current)
+	fields, err := modify(previous)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(fields) == 0 {
+		return previous, nil, nil
+	}
+	update, err := copyHeader(fields)
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range update {
+		current[k] = v
+	}
+	return previous, fields, nil
+}
+
+func (m *Memory) GetChat(ctx context.Context, chatID string) (map[string]interface{}, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, found := m.find(chatID)
+	if !found {
+		return nil, ErrNotFound
+	}
+	return copyHeader(m.chats[id])
+}
+
+func (m *Memory) ListMessages(ctx context.Context, chatID string, start, stop int64) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, found := m.find(chatID)
+	if !found {
+		return nil, nil
+	}
+	messages := m.messages[id]
+	start, stop, ok := rangeOf(len(messages), start, stop)
+	if !ok {
+		return []string{}, nil
+	}
+	return append([]string(nil), messages[start:stop+1]...), nil
+}
+
+func (m *Memory) CountMessages(ctx context.Context, chatID string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, _ := m.find(chatID)
+	return int64(len(m.messages[id])), nil
+}
+
+// ArchivedCount is always zero; the memory store keeps every message.
+func (m *Memory) ArchivedCount(ctx context.Context, chatID string) (int64, error) {
+	return 0, nil
+}
+
+func (m *Memory) MarkRead(ctx context.Context, chatID string) error {
+	_, err := m.UpdateChat(ctx, chatID, map[string]interface{}{"unread": 0})
+	return err
+}
+
+func (m *Memory) ListChats(ctx context.Context, inbox Inbox, start, stop int64) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var ids []string
+	for id := range m.activity {
+		header := m.chats[id]
+		if inbox.AgentID != "" || inbox.Department != "" {
+			if Situation(header) == SituationFinished {
+				continue
+			}
+			if agentID, _ := header["agent_id"].(string); inbox.AgentID != "" && agentID != inbox.AgentID {
+				continue
+			}
+			if department, _ := header["department"].(string); inbox.AgentID == "" && department != inbox.Department {
+				continue
+			}
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return m.activity[ids[i]].After(m.activity[ids[j]])
+	})
+	start, stop, ok := rangeOf(len(ids), start, stop)
+	if !ok {
+		return []string{}, nil
+	}
+	return ids[start : stop+1], nil
+}
+
+// rangeOf resolves LRANGE-style indexes against a list of length n.
+func rangeOf(n int, start, stop int64) (int64, int64, bool) {
+	length := int64(n)
+	if start < 0 {
+		start += length
+	}
+	if stop < 0 {
+		stop += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= length {
+		stop = length - 1
+	}
+	return start, stop, start <= stop
+}
+
+func (m *Memory) find(chatID string) (string, bool) {
+	for _, id := range redis.PossibleChatIDs(chatID) {
+		if _, ok := m.chats[id]; ok {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+func copyHeader(header map[string]interface{}) (map[string]interface{}, error) {
+	b, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	chatObj := make(map[string]interface{}, len(header))
+	if err := json.Unmarshal(b, &chatObj); err != nil {
+		return nil, err
+	}
+	return chatObj, nil
+}
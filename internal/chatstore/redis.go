@@ -0,0 +1,84 @@
+package chatstore
+
+import (
+	"context"
+	"errors"
+
+	redis "wasolgo/internal/redis"
+
+	rdb "github.com/redis/go-redis/v9"
+)
+
+type redisStore struct {
+	client *rdb.Client
+}
+
+// NewRedis returns a Store backed by the chat:<id> keys in Redis.
+func NewRedis(client *rdb.Client) Store {
+	return &redisStore{client: client}
+}
+
+func (s *redisStore) FindChat(ctx context.Context, chatID string) (string, bool, error) {
+	return redis.FindChat(ctx, s.client, chatID)
+}
+
+func (s *redisStore) ResolveChatID(ctx context.Context, chatID string) (string, error) {
+	return redis.FindExistingChatID(ctx, s.client, chatID)
+}
+
+func (s *redisStore) EnsureChat(ctx context.Context, chatID string, header map[string]interface{}) (string, bool, error) {
+	return redis.EnsureChat(ctx, s.client, chatID, header)
+}
+
+func (s *redisStore) AppendMessage(ctx context.Context, chatID, messageJSON string, inbound bool, header map[string]interface{}) (string, bool, error) {
+	return redis.AppendMessage(ctx, s.client, chatID, messageJSON, inbound, header)
+}
+
+func (s *redisStore) UpdateChat(ctx context.Context, chatID string, fields map[string]interface{}) (map[string]interface{}, error) {
+	previous, err := redis.UpdateChat(ctx, s.client, chatID, fields)
+	return previous, notFound(err)
+}
+
+func (s *redisStore) ModifyChat(ctx context.Context, chatID string, modify func(map[string]interface{}) (map[string]interface{}, error)) (map[string]interface{}, map[string]interface{}, error) {
+	previous, fields, err := redis.ModifyChat(ctx, s.client, chatID, modify)
+	return previous, fields, notFound(err)
+}
+
+func (s *redisStore) GetChat(ctx context.Context, chatID string) (map[string]interface{}, error) {
+	chatObj, err := redis.GetChat(ctx, s.client, chatID)
+	return chatObj, notFound(err)
+}
+
+func (s *redisStore) ListMessages(ctx context.Context, chatID string, start, stop int64) ([]string, error) {
+	return redis.ListMessages(ctx, s.client, chatID, start, stop)
+}
+
+func (s *redisStore) CountMessages(ctx context.Context, chatID string) (int64, error) {
+	return redis.CountMessages(ctx, s.client, chatID)
+}
+
+func (s *redisStore) ArchivedCount(ctx context.Context, chatID string) (int64, error) {
+	return redis.ArchivedCount(ctx, s.client, chatID)
+}
+
+func (s *redisStore) MarkRead(ctx context.Context, chatID string) error {
+	return notFound(redis.MarkRead(ctx, s.client, chatID))
+}
+
+func (s *redisStore) ListChats(ctx context.Context, inbox Inbox, start, stop int64) ([]string, error) {
+	key := redis.ActivityKey
+	switch {
+	case inbox.AgentID != "":
+		key = redis.AgentInboxKey(inbox.AgentID)
+	case inbox.Department != "":
+		key = redis.DepartmentInboxKey(inbox.Department)
+	}
+	return redis.ListChats(ctx, s.client, key, start, stop)
+}
+
+func notFound(err error) error {
+	if errors.Is(err, rdb.Nil) {
+		return ErrNotFound
+	}
+	return err
+}
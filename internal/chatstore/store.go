@@ -0,0 +1,63 @@
+// Package chatstore holds the chat headers and message lists that back the
+// agent inbox. The Redis store is used in production; the in-memory store
+// serves the dry-run mode and tests of the message handlers.
+package chatstore
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrNotFound is returned when none of the variants of a chat ID exists.
+var ErrNotFound = errors.New("chat not found")
+
+// Store resolves chats by any of their ID variants and keeps their headers
+// and messages.
+type Store interface {
+	// FindChat returns the ID of the existing chat among the variants of
+	// chatID, and false when none exists.
+	FindChat(ctx context.Context, chatID string) (string, bool, error)
+	// ResolveChatID is FindChat falling back, when the chat doesn't exist, to
+	// the ID a dropped chat was stored under and then to the canonical ID.
+	// Archived history is kept under that ID.
+	ResolveChatID(ctx context.Context, chatID string) (string, error)
+	// EnsureChat resolves the chat for chatID, creating it with header when it
+	// doesn't exist. It returns the chat ID used and whether it was created.
+	EnsureChat(ctx context.Context, chatID string, header map[string]interface{}) (string, bool, error)
+	// AppendMessage is EnsureChat followed by appending messageJSON to the
+	// chat, done atomically. It also refreshes the chat's activity and
+	// last-message preview, and counts inbound messages as unread.
+	AppendMessage(ctx context.Context, chatID, messageJSON string, inbound bool, header map[string]interface{}) (string, bool, error)
+	// UpdateChat merges fields into the chat header and returns the header as
+	// it was before the update.
+	UpdateChat(ctx context.Context, chatID string, fields map[string]interface{}) (map[string]interface{}, error)
+	// ModifyChat merges the fields modify returns for the current header,
+	// atomically with reading it, so checks made by modify hold when the
+	// fields are written. modify may be called more than once and must not
+	// change the header it is given; a nil result leaves the chat as it is
+	// and an error is returned without updating it. ModifyChat returns the
+	// header as it was before and the fields applied.
+	ModifyChat(ctx context.Context, chatID string, modify func(header map[string]interface{}) (map[string]interface{}, error)) (map[string]interface{}, map[string]interface{}, error)
+	GetChat(ctx context.Context, chatID string) (map[string]interface{}, error)
+	// ListMessages returns the messages between start and stop, inclusive,
+	// with negative indexes counting from the end as in LRANGE.
+	ListMessages(ctx context.Context, chatID string, start, stop int64) ([]string, error)
+	// CountMessages returns the number of messages ListMessages can return.
+	CountMessages(ctx context.Context, chatID string) (int64, error)
+	// ArchivedCount returns how many older messages were moved out of the
+	// store by the archiver; ListMessages index 0 is that position of the
+	// chat's history.
+	ArchivedCount(ctx context.Context, chatID string) (int64, error)
+	// MarkRead resets the unread counter of the chat.
+	MarkRead(ctx context.Context, chatID string) error
+	// ListChats returns the IDs of the chats in inbox, most recent activity
+	// first, between start and stop as in ListMessages.
+	ListChats(ctx context.Context, inbox Inbox, start, stop int64) ([]string, error)
+}
+
+// Inbox selects the active chats of an agent or, when AgentID is empty, of a
+// department. The zero Inbox lists every chat, finished ones included.
+type Inbox struct {
+	AgentID    string
+	Department string
+}
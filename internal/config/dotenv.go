@@ -3,6 +3,9 @@ package config
 import (
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -11,6 +14,69 @@ type EnvVars struct {
 	RabbitUrl string
 	DbUrl     string
 	RedisUrl  string
+
+	// ChatHeaderLayout is "list" (default) or "hash", the layout used for
+	// new Redis chat headers.
+	ChatHeaderLayout string
+	// DryRun keeps chats in memory instead of Redis, for trying the consumers
+	// against a staging broker without touching the inbox.
+	DryRun bool
+
+	// ChatDefaultDepartment is the queue reopened chats go to under the
+	// requeue policy.
+	ChatDefaultDepartment string
+	ChatReopenPolicy      string
+	// ChatReopenPolicies are department:policy overrides of ChatReopenPolicy.
+	ChatReopenPolicies []string
+
+	// ChatRetentionMessages and ChatRetentionDays bound the messages kept in
+	// Redis per chat; older ones are archived to Postgres. Zero disables a
+	// limit.
+	ChatRetentionMessages int
+	ChatRetentionDays     int
+	ChatFinishedGrace     time.Duration
+	ChatArchiveInterval   time.Duration
+
+	// ChatFeed publishes chat changes to the feed:<instance> streams, capped
+	// at about ChatFeedMaxLen entries, and with ChatFeedPubSub also to the
+	// chat:<id>:events channels. ChatFeedGroups are created on every stream.
+	ChatFeed       bool
+	ChatFeedMaxLen int
+	ChatFeedPubSub bool
+	ChatFeedGroups []string
+
+	HTTPConnectTimeout      time.Duration
+	HTTPResponseTimeout     time.Duration
+	HTTPTimeout             time.Duration
+	HTTPMaxIdleConnsPerHost int
+	HTTPHostRate            float64
+	HTTPHostBurst           int
+	EvolutionInstanceRate   float64
+	EvolutionInstanceBurst  int
+
+	HTTPAllowedHosts  []string
+	HTTPAllowedCIDRs  []string
+	HTTPAllowlistOnly bool
+	HTTPAllowPrivate  bool
+	// HTTPProxy is empty to use the proxy environment variables, "none" to
+	// connect directly, or a proxy URL. The proxy must enforce egress rules
+	// itself; destinations are only checked before being handed to it.
+	HTTPProxy string
+
+	// MetricsAddr serves expvar metrics on /debug/vars when set.
+	MetricsAddr string
+
+	WebhookWorkers      int
+	WebhookPollInterval time.Duration
+	WebhookMaxAttempts  int
+	WebhookDisableAfter int
+	// WebhookRefreshInterval is the fallback reload interval of the webhook
+	// registry when change notifications are missed.
+	WebhookRefreshInterval time.Duration
+
+	WebhookMaxInFlight      int
+	WebhookBreakerThreshold int
+	WebhookBreakerCooldown  time.Duration
 }
 
 func LoadEnv() (EnvVars, error) {
@@ -28,5 +94,112 @@ func LoadEnv() (EnvVars, error) {
 		RabbitUrl: RabbitUrl,
 		DbUrl:     DBUrl,
 		RedisUrl:  RedisUrl,
+
+		ChatHeaderLayout: os.Getenv("CHAT_HEADER_LAYOUT"),
+		DryRun:           getBool("DRY_RUN", false),
+
+		ChatDefaultDepartment: os.Getenv("CHAT_DEFAULT_DEPARTMENT"),
+		ChatReopenPolicy:      os.Getenv("CHAT_REOPEN_POLICY"),
+		ChatReopenPolicies:    getList("CHAT_REOPEN_POLICIES"),
+
+		ChatRetentionMessages: getInt("CHAT_RETENTION_MESSAGES", 0),
+		ChatRetentionDays:     getInt("CHAT_RETENTION_DAYS", 0),
+		ChatFinishedGrace:     getDuration("CHAT_FINISHED_GRACE", 0),
+		ChatArchiveInterval:   getDuration("CHAT_ARCHIVE_INTERVAL", 10*time.Minute),
+
+		ChatFeed:       getBool("CHAT_FEED_ENABLED", false),
+		ChatFeedMaxLen: getInt("CHAT_FEED_MAXLEN", 10000),
+		ChatFeedPubSub: getBool("CHAT_FEED_PUBSUB", false),
+		ChatFeedGroups: getList("CHAT_FEED_GROUPS"),
+
+		HTTPConnectTimeout:      getDuration("HTTP_CONNECT_TIMEOUT", 5*time.Second),
+		HTTPResponseTimeout:     getDuration("HTTP_RESPONSE_TIMEOUT", 30*time.Second),
+		HTTPTimeout:             getDuration("HTTP_TIMEOUT", 60*time.Second),
+		HTTPMaxIdleConnsPerHost: getInt("HTTP_MAX_IDLE_CONNS_PER_HOST", 10),
+		HTTPHostRate:            getFloat("HTTP_HOST_RATE", 0),
+		HTTPHostBurst:           getInt("HTTP_HOST_BURST", 1),
+		EvolutionInstanceRate:   getFloat("EVOLUTION_INSTANCE_RATE", 0),
+		EvolutionInstanceBurst:  getInt("EVOLUTION_INSTANCE_BURST", 1),
+
+		HTTPAllowedHosts:  getList("HTTP_ALLOWED_HOSTS"),
+		HTTPAllowedCIDRs:  getList("HTTP_ALLOWED_CIDRS"),
+		HTTPAllowlistOnly: getBool("HTTP_ALLOWLIST_ONLY", false),
+		HTTPAllowPrivate:  getBool("HTTP_ALLOW_PRIVATE", false),
+		HTTPProxy:         os.Getenv("HTTP_OUTBOUND_PROXY"),
+
+		MetricsAddr: os.Getenv("METRICS_ADDR"),
+
+		WebhookWorkers:      getInt("WEBHOOK_WORKERS", 4),
+		WebhookPollInterval: getDuration("WEBHOOK_POLL_INTERVAL", 2*time.Second),
+		WebhookMaxAttempts:  getInt("WEBHOOK_MAX_ATTEMPTS", 10),
+		WebhookDisableAfter: getInt("WEBHOOK_DISABLE_AFTER", 50),
+
+		WebhookRefreshInterval: getDuration("WEBHOOK_REFRESH_INTERVAL", time.Minute),
+
+		WebhookMaxInFlight:      getInt("WEBHOOK_MAX_IN_FLIGHT", 2),
+		WebhookBreakerThreshold: getInt("WEBHOOK_BREAKER_THRESHOLD", 5),
+		WebhookBreakerCooldown:  getDuration("WEBHOOK_BREAKER_COOLDOWN", 30*time.Second),
 	}, nil
 }
+
+func getDuration(key string, def time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		fmt.Printf("Invalid duration for %s: %q, using %s", key, value, def)
+		return def
+	}
+	return d
+}
+
+func getInt(key string, def int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		fmt.Printf("Invalid integer for %s: %q, using %d", key, value, def)
+		return def
+	}
+	return i
+}
+
+func getFloat(key string, def float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		fmt.Printf("Invalid number for %s: %q, using %g", key, value, def)
+		return def
+	}
+	return f
+}
+
+func getBool(key string, def bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		fmt.Printf("Invalid boolean for %s: %q, using %t", key, value, def)
+		return def
+	}
+	return b
+}
+
+func getList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -8,13 +8,21 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"wasolgo/internal/api"
+	"wasolgo/internal/chatstore"
+	"wasolgo/internal/database"
 	"wasolgo/internal/parser"
 	"wasolgo/internal/process"
 	"wasolgo/internal/redis"
 
 	amqp "github.com/rabbitmq/amqp091-go"
-	rdb "github.com/redis/go-redis/v9"
+)
+
+const (
+	maxRedeliveries   = 5
+	defaultRetryDelay = 5 * time.Second
 )
 
 func RunConsumer(
@@ -22,7 +30,8 @@ func RunConsumer(
 	rabbitURL string,
 	dbClient *sql.DB,
 	queueName string,
-	redisConn *rdb.Client,
+	store chatstore.Store,
+	webhooks *database.WebhookRegistry,
 ) error {
 	conn, err := amqp.Dial(rabbitURL)
 	if err != nil {
@@ -50,6 +59,13 @@ func RunConsumer(
 	if err != nil {
 		return err
 	}
+	if err := declareRetryQueues(ch, queueName); err != nil {
+		return err
+	}
+	// Retries are only acked once the broker has confirmed their copy.
+	if err := ch.Confirm(false); err != nil {
+		return err
+	}
 
 	msgs, err := ch.Consume(
 		queueName,
@@ -86,18 +102,21 @@ func RunConsumer(
 			go func(delivery amqp.Delivery) {
 				log.Printf("[DEBUG] Received delivery for queue: %s", queueName)
 				var err error
+				var result interface{}
 				switch queueName {
 				case "incoming_requests", "evolution.messages.upsert":
-					err = process.ProcessIncoming(delivery, redisConn, dbClient)
+					err = process.ProcessIncoming(delivery, store, dbClient, webhooks)
 				case "outgoing_requests":
-					err = process.ProcessOutgoing(delivery, dbClient)
+					result, err = process.ProcessOutgoing(delivery, dbClient, webhooks, store)
 				case "evolution.send.message":
 					type Key struct {
 						RemoteJid string `json:"remote_jid"`
+						ID        string `json:"id"`
 					}
 					type StatusString struct {
-						Key     *Key        `json:"key"`
-						Message interface{} `json:"message"`
+						Key        *Key        `json:"key"`
+						Message    interface{} `json:"message"`
+						InstanceID string      `json:"instance_id"`
 					}
 					type SendMessageResponse struct {
 						StatusString *StatusString `json:"status_string"`
@@ -112,7 +131,6 @@ func RunConsumer(
 					if resp.StatusString != nil && resp.StatusString.Key != nil && resp.StatusString.Message != nil {
 						log.Printf("[DEBUG] Entered evolution.send.message handler, resp: %+v", resp)
 						chatID := redis.NormalizeChatID(resp.StatusString.Key.RemoteJid)
-						remoteJid := chatID
 
 						var msgContent parser.MessageContent
 						msgBytes, _ := json.Marshal(resp.StatusString.Message)
@@ -136,6 +154,11 @@ func RunConsumer(
 						if base64Body != "" {
 							messageMap["body"] = base64Body
 						}
+						// The send response carries no time; stamp the message so
+						// the archiver can date it.
+						if _, ok := messageMap["timestamp"]; !ok {
+							messageMap["timestamp"] = time.Now().UTC().Format(time.RFC3339)
+						}
 
 						messageJSON, err := json.Marshal(messageMap)
 						if err != nil {
@@ -146,33 +169,45 @@ func RunConsumer(
 
 						log.Printf("[DEBUG] Final messageJSON to Redis: %s", string(messageJSON))
 
-						var chatKeyToUse string
-						possibleIDs := redis.PossibleChatIDs(resp.StatusString.Key.RemoteJid)
-						for _, id := range possibleIDs {
-							key := "chat:" + id
-							exists, err := redisConn.Exists(context.Background(), key).Result()
-							if err == nil && exists > 0 {
-								chatKeyToUse = id
-								break
-							}
-						}
-						if chatKeyToUse == "" {
-							chatKeyToUse = chatID
-						}
-
-						if err := redis.InsertMessageToChat(
+						chatKeyToUse, _, err := store.AppendMessage(
 							context.Background(),
-							redisConn,
-							chatKeyToUse,
+							chatID,
 							string(messageJSON),
-							remoteJid,
-							nil,
-							nil,
-						); err != nil {
+							false,
+							redis.NewChatHeader(chatID, chatID, resp.StatusString.InstanceID),
+						)
+						if err != nil {
 							log.Printf("Failed to insert message to Redis: %v", err)
 							delivery.Nack(false, false)
 							return
 						}
+						change, err := chatstore.AgentMessage(context.Background(), store, chatKeyToUse)
+						if err != nil {
+							log.Printf("Failed to update situation of chat %s: %v", chatKeyToUse, err)
+						}
+						process.SyncChatState(dbClient, chatKeyToUse, change)
+
+						sent := &api.EventMessage{ID: resp.StatusString.Key.ID, Type: "text"}
+						if msgContent.Conversation != nil {
+							sent.Text = *msgContent.Conversation
+						}
+						if doc := msgContent.DocumentMessage; doc != nil {
+							sent.Type = "document"
+							sent.Text = "📄 Documento enviado"
+							sent.Media = &api.EventMedia{
+								MimeType: doc.Mimetype,
+								FileName: doc.FileName,
+								Url:      doc.Url,
+							}
+						}
+						process.NotifyMessageSent(
+							dbClient,
+							webhooks,
+							store,
+							chatKeyToUse,
+							resp.StatusString.InstanceID,
+							sent,
+						)
 					}
 					if err := delivery.Ack(false); err != nil {
 						log.Printf("Failed to acknowledge message: %v", err)
@@ -181,6 +216,29 @@ func RunConsumer(
 				default:
 					log.Printf("[DEBUG] Unhandled queueName: %s", queueName)
 				}
+				if err != nil {
+					if delay, ok := api.RetryDelay(err); ok && deliveryCount(delivery)+retryCount(delivery) < maxRedeliveries {
+						if delay <= 0 {
+							delay = defaultRetryDelay
+						}
+						if tier, ok := retryTier(delay); ok {
+							log.Printf("Retryable error processing message, retrying in %s: %v", tier, err)
+							if retryErr := scheduleRetry(ctx, ch, queueName, delivery, tier); retryErr != nil {
+								log.Printf("Failed to schedule retry, requeueing: %v", retryErr)
+								delivery.Nack(false, true)
+								return
+							}
+							if err := delivery.Ack(false); err != nil {
+								log.Printf("Failed to acknowledge message: %v", err)
+							}
+							return
+						}
+						log.Printf("Retry delay %s exceeds the longest retry queue, not retrying", delay)
+					}
+				}
+				if result != nil {
+					reply(ctx, ch, delivery, result)
+				}
 				if err != nil {
 					log.Printf("Error processing message: %v", err)
 					delivery.Nack(false, false)
@@ -193,3 +251,40 @@ func RunConsumer(
 		}
 	}
 }
+
+func reply(ctx context.Context, ch *amqp.Channel, delivery amqp.Delivery, result interface{}) {
+	if delivery.ReplyTo == "" {
+		return
+	}
+	body, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("Failed to marshal reply: %v", err)
+		return
+	}
+	err = ch.PublishWithContext(ctx, "", delivery.ReplyTo, false, false, amqp.Publishing{
+		ContentType:   "application/json",
+		CorrelationId: delivery.CorrelationId,
+		Body:          body,
+	})
+	if err != nil {
+		log.Printf("Failed to publish reply to %s: %v", delivery.ReplyTo, err)
+	}
+}
+
+// deliveryCount returns how many times a quorum queue has already delivered
+// this message.
+func deliveryCount(delivery amqp.Delivery) int64 {
+	return headerInt(delivery.Headers["x-delivery-count"])
+}
+
+func headerInt(value interface{}) int64 {
+	switch v := value.(type) {
+	case int64:
+		return v
+	case int32:
+		return int64(v)
+	case int:
+		return int64(v)
+	}
+	return 0
+}
@@ -0,0 +1,110 @@
+package consumer
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Retryable failures are parked in a retry queue instead of holding the
+// delivery: each retry queue has a fixed message TTL and dead-letters back
+// into the work queue, so the consumer acks the original and moves on. The
+// delays are fixed tiers because RabbitMQ only expires messages at the head of
+// a queue, and a single queue with per-message TTLs would hold short delays
+// behind long ones. Delays beyond the last tier aren't retried, since an
+// early retry would spend an attempt against the server's own Retry-After.
+var retryDelays = []time.Duration{
+	5 * time.Second,
+	15 * time.Second,
+	30 * time.Second,
+	time.Minute,
+	5 * time.Minute,
+	15 * time.Minute,
+}
+
+// retriesHeader counts the trips a message made through the retry queues,
+// since republishing resets x-delivery-count.
+const retriesHeader = "x-wasolgo-retries"
+
+func retryQueueName(queueName string, delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%ds", queueName, int(delay/time.Second))
+}
+
+// declareRetryQueues declares the retry queues of queueName.
+func declareRetryQueues(ch *amqp.Channel, queueName string) error {
+	for _, delay := range retryDelays {
+		_, err := ch.QueueDeclare(
+			retryQueueName(queueName, delay),
+			true,  // durable
+			false, // autoDelete
+			false, // exclusive
+			false, // noWait
+			amqp.Table{
+				"x-message-ttl":             delay.Milliseconds(),
+				"x-dead-letter-exchange":    "",
+				"x-dead-letter-routing-key": queueName,
+			},
+		)
+		if err != nil {
+			return fmt.Errorf("couldn't declare retry queue for %s: %w", queueName, err)
+		}
+	}
+	return nil
+}
+
+// retryTier returns the shortest retry delay covering delay, and false when
+// delay is longer than every tier.
+func retryTier(delay time.Duration) (time.Duration, bool) {
+	for _, tier := range retryDelays {
+		if delay <= tier {
+			return tier, true
+		}
+	}
+	return 0, false
+}
+
+// scheduleRetry republishes the delivery to the retry queue of tier and
+// waits for the broker to confirm it. The caller acks the original once it
+// returns nil, and requeues it otherwise.
+func scheduleRetry(ctx context.Context, ch *amqp.Channel, queueName string, delivery amqp.Delivery, tier time.Duration) error {
+	headers := amqp.Table{}
+	for k, v := range delivery.Headers {
+		headers[k] = v
+	}
+	// The copy starts a fresh delivery count; the retries header carries the
+	// attempts so far.
+	delete(headers, "x-delivery-count")
+	headers[retriesHeader] = retryCount(delivery) + 1
+
+	confirmation, err := ch.PublishWithDeferredConfirmWithContext(ctx, "", retryQueueName(queueName, tier), false, false, amqp.Publishing{
+		Headers:         headers,
+		ContentType:     delivery.ContentType,
+		ContentEncoding: delivery.ContentEncoding,
+		DeliveryMode:    amqp.Persistent,
+		CorrelationId:   delivery.CorrelationId,
+		ReplyTo:         delivery.ReplyTo,
+		MessageId:       delivery.MessageId,
+		Timestamp:       delivery.Timestamp,
+		Type:            delivery.Type,
+		AppId:           delivery.AppId,
+		Body:            delivery.Body,
+	})
+	if err != nil {
+		return err
+	}
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !acked {
+		return fmt.Errorf("broker rejected the retry")
+	}
+	return nil
+}
+
+// retryCount returns how many times the message went through a retry queue.
+func retryCount(delivery amqp.Delivery) int64 {
+	return headerInt(delivery.Headers[retriesHeader])
+}
@@ -0,0 +1,31 @@
+package consumer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryTier(t *testing.T) {
+	tests := []struct {
+		delay time.Duration
+		want  time.Duration
+		ok    bool
+	}{
+		{time.Second, 5 * time.Second, true},
+		{5 * time.Second, 5 * time.Second, true},
+		{20 * time.Second, 30 * time.Second, true},
+		{time.Minute, time.Minute, true},
+		{90 * time.Second, 5 * time.Minute, true},
+		{10 * time.Minute, 15 * time.Minute, true},
+		{time.Hour, 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := retryTier(tt.delay)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("retryTier(%s) = %s, %t, want %s, %t", tt.delay, got, ok, tt.want, tt.ok)
+		}
+		if ok && got < tt.delay {
+			t.Errorf("retryTier(%s) = %s retries too early", tt.delay, got)
+		}
+	}
+}
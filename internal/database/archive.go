@@ -0,0 +1,85 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// ArchiveMessages stores messages of a chat trimmed from Redis, the first one
+// at position seq of the chat's history. Payloads are kept verbatim so they
+// read back exactly as Redis held them. Positions written by an earlier,
+// interrupted run are overwritten, since a merge may have put other messages
+// there since.
+func ArchiveMessages(db Executor, chatID string, seq int64, messages []string) error {
+	query := `
+INSERT INTO chat_message_archive (chat_id, seq, payload)
+SELECT $1, $2 + t.i - 1, t.payload FROM unnest($3::text[]) WITH ORDINALITY AS t(payload, i)
+ON CONFLICT (chat_id, seq) DO UPDATE SET payload = EXCLUDED.payload, archived_at = now()
+`
+	if _, err := db.Exec(query, chatID, seq, pq.Array(messages)); err != nil {
+		return fmt.Errorf("couldn't archive messages of chat %s: %w", chatID, err)
+	}
+	return nil
+}
+
+// CountArchivedMessages returns how many positions in [from, to) of the
+// chat's history are archived.
+func CountArchivedMessages(db *sql.DB, chatID string, from, to int64) (int64, error) {
+	var n int64
+	query := "SELECT COUNT(*) FROM chat_message_archive WHERE chat_id = $1 AND seq >= $2 AND seq < $3"
+	if err := db.QueryRow(query, chatID, from, to).Scan(&n); err != nil {
+		return 0, fmt.Errorf("couldn't count archived messages of chat %s: %w", chatID, err)
+	}
+	return n, nil
+}
+
+// ArchivedMessages returns the archived messages at positions [from, to) of
+// the chat's history, oldest first.
+func ArchivedMessages(db *sql.DB, chatID string, from, to int64) ([]string, error) {
+	rows, err := db.Query("SELECT payload FROM chat_message_archive WHERE chat_id = $1 AND seq >= $2 AND seq < $3 ORDER BY seq", chatID, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read archived messages of chat %s: %w", chatID, err)
+	}
+	defer rows.Close()
+	var messages []string
+	for rows.Next() {
+		var payload string
+		if err := rows.Scan(&payload); err != nil {
+			return nil, err
+		}
+		messages = append(messages, payload)
+	}
+	return messages, rows.Err()
+}
+
+// moveArchivedMessages appends the archived history of each source chat to
+// the target's, in order: positions below archived[id] are the chat's
+// archived messages, and rows at or above it are left by interrupted runs and
+// dropped. Sources without rows were moved by an earlier run and are skipped,
+// so the move can be repeated with the same counts.
+func moveArchivedMessages(tx *sql.Tx, target string, sources []string, archived map[string]int64) error {
+	var pending int64
+	if err := tx.QueryRow("SELECT COUNT(*) FROM chat_message_archive WHERE chat_id = ANY($1)", pq.Array(sources)).Scan(&pending); err != nil {
+		return fmt.Errorf("couldn't count archived messages of merged chats: %w", err)
+	}
+	if pending == 0 {
+		return nil
+	}
+	offset := archived[target]
+	if _, err := tx.Exec("DELETE FROM chat_message_archive WHERE chat_id = $1 AND seq >= $2", target, offset); err != nil {
+		return fmt.Errorf("couldn't clear archived messages of chat %s: %w", target, err)
+	}
+	for _, id := range sources {
+		if _, err := tx.Exec("DELETE FROM chat_message_archive WHERE chat_id = $1 AND seq >= $2", id, archived[id]); err != nil {
+			return fmt.Errorf("couldn't clear archived messages of chat %s: %w", id, err)
+		}
+		query := "UPDATE chat_message_archive SET chat_id = $1, seq = seq + $2 WHERE chat_id = $3"
+		if _, err := tx.Exec(query, target, offset, id); err != nil {
+			return fmt.Errorf("couldn't move archived messages of chat %s to %s: %w", id, target, err)
+		}
+		offset += archived[id]
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// ErrChatNotFound is returned by the chat updates when there is no chats row
+// for the chat.
+var ErrChatNotFound = errors.New("chat not found in database")
+
+// updateChat runs a single-row UPDATE of the chats table and fails when it
+// matched no row.
+func updateChat(db Executor, action, query string, args ...interface{}) error {
+	res, err := db.Exec(query, args...)
+	if err != nil {
+		return fmt.Errorf("couldn't %s chat in database: %w", action, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("couldn't %s chat in database: %w", action, err)
+	}
+	if n == 0 {
+		return fmt.Errorf("couldn't %s chat %v: %w", action, args[0], ErrChatNotFound)
+	}
+	return nil
+}
+
+func CloseChat(db Executor, chatID string, tabulation *string) error {
+	query := "UPDATE chats SET situation = 'finished', is_active = false, tabulation = COALESCE($2, tabulation) WHERE id = $1"
+	return updateChat(db, "close", query, chatID, tabulation)
+}
+
+func TransferChat(db Executor, chatID string, agentID, department *string, situation string) error {
+	query := "UPDATE chats SET agent_id = $2, department = COALESCE($3, department), situation = $4, is_active = true WHERE id = $1"
+	return updateChat(db, "transfer", query, chatID, agentID, department, situation)
+}
+
+func TabulateChat(db Executor, chatID, tabulation string) error {
+	query := "UPDATE chats SET tabulation = $2 WHERE id = $1"
+	return updateChat(db, "tabulate", query, chatID, tabulation)
+}
+
+// chatStateColumns are the chat header fields mirrored in the chats table.
+var chatStateColumns = []string{"situation", "is_active", "agent_id", "department", "tabulation"}
+
+// SetChatState writes the chat header fields that are mirrored in the chats
+// table, such as the situation, to the chat's row. Other fields are ignored.
+func SetChatState(db Executor, chatID string, fields map[string]interface{}) error {
+	var sets []string
+	args := []interface{}{chatID}
+	for _, column := range chatStateColumns {
+		value, ok := fields[column]
+		if !ok {
+			continue
+		}
+		args = append(args, value)
+		sets = append(sets, fmt.Sprintf("%s = $%d", column, len(args)))
+	}
+	if len(sets) == 0 {
+		return nil
+	}
+	query := "UPDATE chats SET " + strings.Join(sets, ", ") + " WHERE id = $1"
+	return updateChat(db, "update the state of", query, args...)
+}
+
+func InsertChatAction(db Executor, chatID, action, performedBy string, details map[string]interface{}) error {
+	detailsJSON, err := json.Marshal(details)
+	if err != nil {
+		return fmt.Errorf("couldn't marshal chat action details: %w", err)
+	}
+	query := "INSERT INTO chat_actions (chat_id, action, performed_by, details) VALUES ($1, $2, $3, $4)"
+	if _, err := db.Exec(query, chatID, action, performedBy, string(detailsJSON)); err != nil {
+		return fmt.Errorf("couldn't insert chat action into database: %w", err)
+	}
+	return nil
+}
+
+// MergeChatIDs moves every reference to the chats in sources to target in
+// one transaction. The target row takes the state of the preferred chat, the
+// archived history of the sources is appended to the target's as counted by
+// archived, and the source rows are removed once nothing points at them. It
+// can be run again with the same arguments once done. It returns the number
+// of messages moved.
+func MergeChatIDs(db *sql.DB, target, preferred string, sources []string, archived map[string]int64) (int64, error) {
+	var moved int64
+	err := WithTx(db, func(tx *sql.Tx) error {
+		if preferred != target {
+			query := `
+INSERT INTO chats (id, situation, is_active, agent_id, tabulation, customer_id, instance_id, department)
+SELECT $1, situation, is_active, agent_id, tabulation, customer_id, instance_id, department FROM chats WHERE id = $2
+ON CONFLICT (id) DO UPDATE
+SET situation = EXCLUDED.situation, is_active = EXCLUDED.is_active, agent_id = EXCLUDED.agent_id, tabulation = EXCLUDED.tabulation,
+	customer_id = EXCLUDED.customer_id, instance_id = EXCLUDED.instance_id, department = EXCLUDED.department
+`
+			if _, err := tx.Exec(query, target, preferred); err != nil {
+				return fmt.Errorf("couldn't copy chat %s into %s: %w", preferred, target, err)
+			}
+		}
+		res, err := tx.Exec("UPDATE messages SET chat_id = $1 WHERE chat_id = ANY($2)", target, pq.Array(sources))
+		if err != nil {
+			return fmt.Errorf("couldn't move messages to chat %s: %w", target, err)
+		}
+		moved, _ = res.RowsAffected()
+		if _, err := tx.Exec("UPDATE chat_actions SET chat_id = $1 WHERE chat_id = ANY($2)", target, pq.Array(sources)); err != nil {
+			return fmt.Errorf("couldn't move chat actions to chat %s: %w", target, err)
+		}
+		if _, err := tx.Exec("UPDATE webhook_deliveries SET chat_id = $1 WHERE chat_id = ANY($2)", target, pq.Array(sources)); err != nil {
+			return fmt.Errorf("couldn't move webhook deliveries to chat %s: %w", target, err)
+		}
+		if err := moveArchivedMessages(tx, target, sources, archived); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE customers SET last_chat_id = $1 WHERE last_chat_id = ANY($2)", target, pq.Array(sources)); err != nil {
+			return fmt.Errorf("couldn't update customers of chat %s: %w", target, err)
+		}
+		if _, err := tx.Exec("DELETE FROM chats WHERE id = ANY($1)", pq.Array(sources)); err != nil {
+			return fmt.Errorf("couldn't delete merged chats: %w", err)
+		}
+		return nil
+	})
+	return moved, err
+}
+
+// CountChatMessages returns the number of messages stored for each of ids.
+func CountChatMessages(db *sql.DB, ids []string) (map[string]int64, error) {
+	rows, err := db.Query("SELECT chat_id, COUNT(*) FROM messages WHERE chat_id = ANY($1) GROUP BY chat_id", pq.Array(ids))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't count chat messages: %w", err)
+	}
+	defer rows.Close()
+	counts := make(map[string]int64, len(ids))
+	for rows.Next() {
+		var id string
+		var n int64
+		if err := rows.Scan(&id, &n); err != nil {
+			return nil, err
+		}
+		counts[id] = n
+	}
+	return counts, rows.Err()
+}
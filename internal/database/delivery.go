@@ -0,0 +1,194 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+	DeliveryCancelled = "cancelled"
+)
+
+type WebhookDelivery struct {
+	ID        int64
+	WebhookID int
+	EventID   string
+	Event     string
+	ChatID    string
+	Payload   []byte
+	Attempts  int
+}
+
+type DeliveryAttempt struct {
+	StatusCode *int
+	Error      string
+	Latency    time.Duration
+}
+
+func EnqueueWebhookDelivery(db Executor, webhookID int, eventID, event, chatID string, payload []byte) error {
+	query := "INSERT INTO webhook_deliveries (webhook_id, event_id, event, chat_id, payload) VALUES ($1, $2, $3, NULLIF($4, ''), $5) ON CONFLICT (webhook_id, event_id) DO NOTHING"
+	if _, err := db.Exec(query, webhookID, eventID, event, chatID, string(payload)); err != nil {
+		return fmt.Errorf("couldn't enqueue webhook delivery: %w", err)
+	}
+	return nil
+}
+
+// ClaimWebhookDeliveries leases up to limit due deliveries by pushing their
+// next_attempt_at forward, so a crashed worker's deliveries become due again
+// once the lease expires.
+func ClaimWebhookDeliveries(db *sql.DB, limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	query := `
+WITH due AS (
+	SELECT id FROM webhook_deliveries
+	WHERE status = 'pending' AND next_attempt_at <= now()
+	ORDER BY next_attempt_at
+	LIMIT $1
+	FOR UPDATE SKIP LOCKED
+)
+UPDATE webhook_deliveries d
+SET next_attempt_at = now() + $2 * interval '1 millisecond', attempts = d.attempts + 1, updated_at = now()
+FROM due
+WHERE d.id = due.id
+RETURNING d.id, d.webhook_id, d.event_id, d.event, COALESCE(d.chat_id, ''), d.payload, d.attempts
+`
+	rows, err := db.Query(query, limit, lease.Milliseconds())
+	if err != nil {
+		return nil, fmt.Errorf("couldn't claim webhook deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.EventID, &d.Event, &d.ChatID, &d.Payload, &d.Attempts); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func RecordDeliveryAttempt(db Executor, d *WebhookDelivery, attempt DeliveryAttempt) error {
+	query := "INSERT INTO webhook_delivery_attempts (delivery_id, attempt, status_code, error, latency_ms) VALUES ($1, $2, $3, NULLIF($4, ''), $5)"
+	if _, err := db.Exec(query, d.ID, d.Attempts, attempt.StatusCode, attempt.Error, attempt.Latency.Milliseconds()); err != nil {
+		return fmt.Errorf("couldn't record delivery attempt: %w", err)
+	}
+	return nil
+}
+
+func MarkDeliveryDelivered(db Executor, d *WebhookDelivery, attempt DeliveryAttempt) error {
+	query := `
+UPDATE webhook_deliveries
+SET status = 'delivered', last_status_code = $2, last_error = NULL, last_latency_ms = $3, delivered_at = now(), updated_at = now()
+WHERE id = $1
+`
+	if _, err := db.Exec(query, d.ID, attempt.StatusCode, attempt.Latency.Milliseconds()); err != nil {
+		return fmt.Errorf("couldn't mark delivery as delivered: %w", err)
+	}
+	return nil
+}
+
+// MarkDeliveryRetry schedules another attempt at nextAttempt, or gives up
+// when nextAttempt is nil.
+func MarkDeliveryRetry(db Executor, d *WebhookDelivery, attempt DeliveryAttempt, nextAttempt *time.Time) error {
+	status := DeliveryPending
+	if nextAttempt == nil {
+		status = DeliveryFailed
+	}
+	query := `
+UPDATE webhook_deliveries
+SET status = $2, last_status_code = $3, last_error = NULLIF($4, ''), last_latency_ms = $5, next_attempt_at = COALESCE($6, next_attempt_at), updated_at = now()
+WHERE id = $1
+`
+	if _, err := db.Exec(query, d.ID, status, attempt.StatusCode, attempt.Error, attempt.Latency.Milliseconds(), nextAttempt); err != nil {
+		return fmt.Errorf("couldn't reschedule delivery: %w", err)
+	}
+	return nil
+}
+
+// DeferDelivery puts a claimed delivery back without counting the claim as
+// an attempt, used when the endpoint is not accepting deliveries right now.
+func DeferDelivery(db Executor, d *WebhookDelivery, at time.Time) error {
+	query := "UPDATE webhook_deliveries SET attempts = attempts - 1, next_attempt_at = $2, updated_at = now() WHERE id = $1"
+	if _, err := db.Exec(query, d.ID, at); err != nil {
+		return fmt.Errorf("couldn't defer delivery: %w", err)
+	}
+	return nil
+}
+
+func CancelWebhookDeliveries(db Executor, webhookID int, reason string) error {
+	query := "UPDATE webhook_deliveries SET status = 'cancelled', last_error = $2, updated_at = now() WHERE webhook_id = $1 AND status = 'pending'"
+	if _, err := db.Exec(query, webhookID, reason); err != nil {
+		return fmt.Errorf("couldn't cancel webhook deliveries: %w", err)
+	}
+	return nil
+}
+
+func ResetWebhookFailures(db Executor, webhookID int) error {
+	if _, err := db.Exec("UPDATE webhook SET consecutive_failures = 0 WHERE id = $1 AND consecutive_failures <> 0", webhookID); err != nil {
+		return fmt.Errorf("couldn't reset webhook failures: %w", err)
+	}
+	return nil
+}
+
+// RecordWebhookFailure bumps the webhook's consecutive failure counter and
+// disables it once the counter reaches disableAfter. It reports whether the
+// webhook was disabled by this call.
+func RecordWebhookFailure(db *sql.DB, webhookID int, disableAfter int) (bool, error) {
+	query := `
+WITH prev AS (SELECT id, enabled FROM webhook WHERE id = $1 FOR UPDATE)
+UPDATE webhook w
+SET consecutive_failures = w.consecutive_failures + 1,
+	enabled = CASE WHEN $2 > 0 AND w.consecutive_failures + 1 >= $2 THEN false ELSE w.enabled END,
+	disabled_at = CASE WHEN w.enabled AND $2 > 0 AND w.consecutive_failures + 1 >= $2 THEN now() ELSE w.disabled_at END
+FROM prev
+WHERE w.id = prev.id
+RETURNING prev.enabled AND NOT w.enabled
+`
+	var disabled bool
+	if err := db.QueryRow(query, webhookID, disableAfter).Scan(&disabled); err != nil {
+		return false, fmt.Errorf("couldn't record webhook failure: %w", err)
+	}
+	return disabled, nil
+}
+
+type DeliveryFilter struct {
+	Since     *time.Time
+	Until     *time.Time
+	ChatID    string
+	WebhookID int
+	Status    string
+}
+
+func (f DeliveryFilter) where() (string, []interface{}) {
+	clause := "WHERE ($1::timestamptz IS NULL OR created_at >= $1) AND ($2::timestamptz IS NULL OR created_at < $2) AND ($3 = '' OR chat_id = $3) AND ($4 = 0 OR webhook_id = $4) AND ($5 = '' OR status = $5)"
+	return clause, []interface{}{f.Since, f.Until, f.ChatID, f.WebhookID, f.Status}
+}
+
+func CountDeliveries(db *sql.DB, filter DeliveryFilter) (int64, error) {
+	where, args := filter.where()
+	var n int64
+	if err := db.QueryRow("SELECT count(*) FROM webhook_deliveries "+where, args...).Scan(&n); err != nil {
+		return 0, fmt.Errorf("couldn't count deliveries: %w", err)
+	}
+	return n, nil
+}
+
+// RequeueDeliveries makes matching deliveries due again with a fresh attempt
+// budget. Their earlier attempts stay in webhook_delivery_attempts.
+func RequeueDeliveries(db *sql.DB, filter DeliveryFilter) (int64, error) {
+	where, args := filter.where()
+	query := "UPDATE webhook_deliveries SET status = 'pending', attempts = 0, next_attempt_at = now(), delivered_at = NULL, updated_at = now() " + where
+	res, err := db.Exec(query, args...)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't requeue deliveries: %w", err)
+	}
+	return res.RowsAffected()
+}
@@ -1,12 +1,11 @@
 package database
 
 import (
-	"database/sql"
 	"fmt"
 	"wasolgo/internal/parser"
 )
 
-func UpsertChat(db *sql.DB, chat *parser.Chat) error {
+func UpsertChat(db Executor, chat *parser.Chat) error {
 	if chat.Tabulation == nil {
 		query := "INSERT INTO chats (id, situation, is_active, agent_id, customer_id, instance_id) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (id) DO UPDATE SET situation = $2, is_active = $3, agent_id = $4, customer_id = $5, instance_id = $6"
 		_, err := db.Exec(query, chat.ID, chat.Situation, chat.IsActive, chat.AgentID, chat.CustomerID, chat.InstanceID)
@@ -28,7 +27,7 @@ SET situation = $2, is_active = $3, agent_id = $4, tabulation = $5, customer_id
 	return nil
 }
 
-func UpsertMessages(db *sql.DB, msg *parser.Message) error {
+func UpsertMessages(db Executor, msg *parser.Message) error {
 	query := "INSERT INTO messages (\"from\", \"to\", text, delivered, chat_id) VALUES ($1, $2, $3, $4, $5)"
 	_, err := db.Exec(query, msg.From, msg.To, msg.Text, msg.Delivered, msg.ChatID)
 	if err != nil {
@@ -37,7 +36,7 @@ func UpsertMessages(db *sql.DB, msg *parser.Message) error {
 	return nil
 }
 
-func UpsertCustomer(db *sql.DB, customer *parser.Customer) error {
+func UpsertCustomer(db Executor, customer *parser.Customer) error {
 	if customer.LastChatID == nil {
 		query := "INSERT INTO customers (id, name, number) VALUES ($1, $2, $3) ON CONFLICT (id) DO UPDATE SET name = $2, number = $3"
 		_, err := db.Exec(query, customer.ID, customer.Name, customer.Number)
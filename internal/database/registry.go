@@ -0,0 +1,120 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+	"wasolgo/internal/api"
+
+	"github.com/lib/pq"
+)
+
+const webhookChannel = "webhook_changed"
+
+// WebhookRegistry keeps the webhook table in memory. It reloads when the
+// webhook_changed trigger notifies a change and, as a fallback, every
+// refresh interval.
+type WebhookRegistry struct {
+	db      *sql.DB
+	dbUrl   string
+	refresh time.Duration
+
+	mu       sync.RWMutex
+	webhooks []api.Webhook
+	byID     map[int]*api.Webhook
+}
+
+func NewWebhookRegistry(db *sql.DB, dbUrl string, refresh time.Duration) (*WebhookRegistry, error) {
+	if refresh <= 0 {
+		refresh = time.Minute
+	}
+	r := &WebhookRegistry{db: db, dbUrl: dbUrl, refresh: refresh}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *WebhookRegistry) Reload() error {
+	webhooks, err := GetAllWebhooks(r.db)
+	if err != nil {
+		return err
+	}
+	list := *webhooks
+	byID := make(map[int]*api.Webhook, len(list))
+	for i := range list {
+		byID[list[i].ID] = &list[i]
+	}
+	r.mu.Lock()
+	r.webhooks = list
+	r.byID = byID
+	r.mu.Unlock()
+	return nil
+}
+
+// All returns the cached webhooks. The slice must not be modified.
+func (r *WebhookRegistry) All() []api.Webhook {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.webhooks
+}
+
+func (r *WebhookRegistry) Get(id int) (*api.Webhook, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	wh, ok := r.byID[id]
+	return wh, ok
+}
+
+// Run keeps the registry up to date until ctx is done.
+func (r *WebhookRegistry) Run(ctx context.Context) {
+	var notify <-chan *pq.Notification
+	listener := pq.NewListener(r.dbUrl, 5*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("[webhooks] Registry listener: %v", err)
+		}
+	})
+	if err := listener.Listen(webhookChannel); err != nil {
+		log.Printf("[webhooks] Couldn't listen for webhook changes, refreshing every %s: %v", r.refresh, err)
+		listener.Close()
+	} else {
+		defer listener.Close()
+		notify = listener.Notify
+	}
+
+	ticker := time.NewTicker(r.refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-notify:
+			// A nil notification means the listener reconnected and may
+			// have missed changes, so it reloads as well. Bursts of changes
+			// are coalesced into one reload.
+			drain(notify, 200*time.Millisecond)
+		case <-ticker.C:
+		}
+		if err := r.Reload(); err != nil {
+			log.Printf("[webhooks] Couldn't reload webhooks: %v", err)
+		}
+	}
+}
+
+func drain(ch <-chan *pq.Notification, quiet time.Duration) {
+	timer := time.NewTimer(quiet)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ch:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(quiet)
+		case <-timer.C:
+			return
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migrations are applied in order on every start, so each statement must be
+// idempotent.
+var migrations = []string{
+	`ALTER TABLE chats ADD COLUMN IF NOT EXISTS department TEXT`,
+	`CREATE TABLE IF NOT EXISTS chat_actions (
+	id BIGSERIAL PRIMARY KEY,
+	chat_id TEXT NOT NULL,
+	action TEXT NOT NULL,
+	performed_by TEXT,
+	details JSONB,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+)`,
+	`CREATE INDEX IF NOT EXISTS chat_actions_chat_id_idx ON chat_actions (chat_id)`,
+	`ALTER TABLE webhook ADD COLUMN IF NOT EXISTS enabled BOOLEAN NOT NULL DEFAULT true`,
+	`ALTER TABLE webhook ADD COLUMN IF NOT EXISTS consecutive_failures INT NOT NULL DEFAULT 0`,
+	`ALTER TABLE webhook ADD COLUMN IF NOT EXISTS disabled_at TIMESTAMPTZ`,
+	`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+	id BIGSERIAL PRIMARY KEY,
+	webhook_id INT NOT NULL,
+	event_id TEXT NOT NULL,
+	event TEXT NOT NULL,
+	chat_id TEXT,
+	payload JSONB NOT NULL,
+	status TEXT NOT NULL DEFAULT 'pending',
+	attempts INT NOT NULL DEFAULT 0,
+	next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	last_status_code INT,
+	last_error TEXT,
+	last_latency_ms INT,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	delivered_at TIMESTAMPTZ
+)`,
+	`CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending'`,
+	`CREATE INDEX IF NOT EXISTS webhook_deliveries_chat_id_idx ON webhook_deliveries (chat_id)`,
+	`CREATE TABLE IF NOT EXISTS webhook_delivery_attempts (
+	id BIGSERIAL PRIMARY KEY,
+	delivery_id BIGINT NOT NULL REFERENCES webhook_deliveries (id) ON DELETE CASCADE,
+	attempt INT NOT NULL,
+	status_code INT,
+	error TEXT,
+	latency_ms INT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+)`,
+	`ALTER TABLE webhook ADD COLUMN IF NOT EXISTS secret TEXT`,
+	`ALTER TABLE webhook ADD COLUMN IF NOT EXISTS secret_secondary TEXT`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS webhook_deliveries_event_idx ON webhook_deliveries (webhook_id, event_id)`,
+	`ALTER TABLE webhook ADD COLUMN IF NOT EXISTS format TEXT NOT NULL DEFAULT 'legacy'`,
+	`ALTER TABLE webhook ADD COLUMN IF NOT EXISTS events TEXT[]`,
+	`ALTER TABLE webhook ADD COLUMN IF NOT EXISTS filter_departments TEXT[]`,
+	`ALTER TABLE webhook ADD COLUMN IF NOT EXISTS filter_tags TEXT[]`,
+	`ALTER TABLE webhook ADD COLUMN IF NOT EXISTS filter_agents TEXT[]`,
+	`ALTER TABLE webhook ADD COLUMN IF NOT EXISTS filter_message_types TEXT[]`,
+	`CREATE OR REPLACE FUNCTION notify_webhook_changed() RETURNS trigger AS $$
+BEGIN
+	IF TG_OP = 'UPDATE' AND (to_jsonb(OLD) - 'consecutive_failures') = (to_jsonb(NEW) - 'consecutive_failures') THEN
+		RETURN NULL;
+	END IF;
+	PERFORM pg_notify('webhook_changed', '');
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql`,
+	`ALTER TABLE webhook ADD COLUMN IF NOT EXISTS headers JSONB`,
+	`ALTER TABLE webhook ADD COLUMN IF NOT EXISTS auth JSONB`,
+	`ALTER TABLE webhook ADD COLUMN IF NOT EXISTS body_template TEXT`,
+	// Created only when missing, so a boot neither locks the webhook table nor
+	// leaves it without the trigger while another instance is running; the
+	// function above is replaced in place.
+	`DO $$
+BEGIN
+	IF NOT EXISTS (SELECT 1 FROM pg_trigger WHERE tgname = 'webhook_changed' AND tgrelid = 'webhook'::regclass) THEN
+		CREATE TRIGGER webhook_changed AFTER INSERT OR UPDATE OR DELETE ON webhook FOR EACH ROW EXECUTE FUNCTION notify_webhook_changed();
+	END IF;
+EXCEPTION WHEN duplicate_object THEN
+	NULL;
+END;
+$$`,
+	`CREATE TABLE IF NOT EXISTS chat_message_archive (
+	chat_id TEXT NOT NULL,
+	seq BIGINT NOT NULL,
+	payload TEXT NOT NULL,
+	archived_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	PRIMARY KEY (chat_id, seq)
+)`,
+}
+
+func Migrate(db *sql.DB) error {
+	for i, stmt := range migrations {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("migration %d failed: %w", i, err)
+		}
+	}
+	return nil
+}
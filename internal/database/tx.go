@@ -0,0 +1,27 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+type Executor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func WithTx(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("couldn't begin transaction: %w", err)
+	}
+	if err := fn(tx); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return fmt.Errorf("%w (rollback failed: %v)", err, rbErr)
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("couldn't commit transaction: %w", err)
+	}
+	return nil
+}
@@ -2,11 +2,57 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
+	"log"
 	"wasolgo/internal/api"
+
+	"github.com/lib/pq"
 )
 
+const webhookColumns = "id, name, url, is_global, conn, send_message, receive_message, enabled, secret, secret_secondary, format, events, filter_departments, filter_tags, filter_agents, filter_message_types, headers, auth, body_template"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanWebhook(row rowScanner) (api.Webhook, error) {
+	var web api.Webhook
+	var conn, secret, secondary, format, bodyTemplate sql.NullString
+	var headers, auth []byte
+	if err := row.Scan(&web.ID, &web.Name, &web.Url, &web.IsGlobal, &conn, &web.SendMessage, &web.ReceiveMessage, &web.Enabled, &secret, &secondary, &format,
+		pq.Array(&web.Events), pq.Array(&web.Filter.Departments), pq.Array(&web.Filter.Tags), pq.Array(&web.Filter.Agents), pq.Array(&web.Filter.MessageTypes),
+		&headers, &auth, &bodyTemplate); err != nil {
+		return web, err
+	}
+	if conn.Valid {
+		web.Conn = &conn.String
+	} else {
+		web.Conn = nil
+	}
+	web.Secret = secret.String
+	web.SecondarySecret = secondary.String
+	web.Format = format.String
+	web.BodyTemplate = bodyTemplate.String
+	if len(headers) > 0 {
+		if err := json.Unmarshal(headers, &web.Headers); err != nil {
+			log.Printf("[webhooks] Webhook %d has invalid headers, ignoring them: %v", web.ID, err)
+		}
+	}
+	if len(auth) > 0 && string(auth) != "null" {
+		web.Auth = &api.WebhookAuth{}
+		if err := json.Unmarshal(auth, web.Auth); err != nil {
+			log.Printf("[webhooks] Webhook %d has unreadable auth config: %v", web.ID, err)
+			web.Auth = &api.WebhookAuth{Type: "invalid"}
+		}
+	}
+	if err := web.Compile(); err != nil {
+		log.Printf("[webhooks] %v", err)
+	}
+	return web, nil
+}
+
 func GetAllWebhooks(db *sql.DB) (*[]api.Webhook, error) {
-	rows, err := db.Query("SELECT id, name, url, is_global, conn, send_message, receive_message FROM webhook")
+	rows, err := db.Query("SELECT " + webhookColumns + " FROM webhook")
 	if err != nil {
 		return nil, err
 	}
@@ -14,16 +60,10 @@ func GetAllWebhooks(db *sql.DB) (*[]api.Webhook, error) {
 
 	var webhooks []api.Webhook
 	for rows.Next() {
-		var web api.Webhook
-		var conn sql.NullString
-		if err := rows.Scan(&web.ID, &web.Name, &web.Url, &web.IsGlobal, &conn, &web.SendMessage, &web.ReceiveMessage); err != nil {
+		web, err := scanWebhook(rows)
+		if err != nil {
 			return nil, err
 		}
-		if conn.Valid {
-			web.Conn = &conn.String
-		} else {
-			web.Conn = nil
-		}
 		webhooks = append(webhooks, web)
 	}
 	if err := rows.Err(); err != nil {
@@ -31,3 +71,11 @@ func GetAllWebhooks(db *sql.DB) (*[]api.Webhook, error) {
 	}
 	return &webhooks, nil
 }
+
+func GetWebhook(db *sql.DB, id int) (*api.Webhook, error) {
+	web, err := scanWebhook(db.QueryRow("SELECT "+webhookColumns+" FROM webhook WHERE id = $1", id))
+	if err != nil {
+		return nil, err
+	}
+	return &web, nil
+}
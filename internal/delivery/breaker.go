@@ -0,0 +1,108 @@
+package delivery
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// endpoint guards one webhook: at most maxInFlight concurrent deliveries and
+// a circuit breaker that opens after threshold consecutive failures. Once
+// cooldown has passed a single probe is let through (half-open); its outcome
+// closes or re-opens the breaker.
+type endpoint struct {
+	id          int
+	maxInFlight int
+	threshold   int
+	cooldown    time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	inFlight int
+}
+
+// acquire reserves a delivery slot. When it returns false the caller must not
+// send and should retry after the returned delay.
+func (e *endpoint) acquire(now time.Time) (bool, time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	switch e.state {
+	case breakerOpen:
+		if wait := e.openedAt.Add(e.cooldown).Sub(now); wait > 0 {
+			return false, wait
+		}
+		e.setState(breakerHalfOpen)
+	case breakerHalfOpen:
+		if e.inFlight > 0 {
+			return false, e.cooldown
+		}
+	}
+	if e.maxInFlight > 0 && e.inFlight >= e.maxInFlight {
+		return false, time.Second
+	}
+	e.inFlight++
+	return true, 0
+}
+
+func (e *endpoint) release(success bool, now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.inFlight--
+	if success {
+		e.failures = 0
+		if e.state != breakerClosed {
+			e.setState(breakerClosed)
+		}
+		return
+	}
+	e.failures++
+	if e.state == breakerHalfOpen || (e.threshold > 0 && e.failures >= e.threshold && e.state == breakerClosed) {
+		e.openedAt = now
+		e.setState(breakerOpen)
+	}
+}
+
+func (e *endpoint) setState(state breakerState) {
+	log.Printf("[webhooks] Circuit breaker for webhook %d: %s -> %s (consecutive failures: %d)", e.id, e.state, state, e.failures)
+	recordBreakerState(e.id, state)
+	e.state = state
+}
+
+type endpoints struct {
+	mu          sync.Mutex
+	maxInFlight int
+	threshold   int
+	cooldown    time.Duration
+	byID        map[int]*endpoint
+}
+
+func (es *endpoints) get(id int) *endpoint {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	e, ok := es.byID[id]
+	if !ok {
+		e = &endpoint{id: id, maxInFlight: es.maxInFlight, threshold: es.threshold, cooldown: es.cooldown}
+		es.byID[id] = e
+	}
+	return e
+}
@@ -0,0 +1,277 @@
+package delivery
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"wasolgo/internal/api"
+	"wasolgo/internal/database"
+)
+
+type Config struct {
+	Workers      int
+	BatchSize    int
+	PollInterval time.Duration
+	Lease        time.Duration
+	MaxAttempts  int
+	BaseBackoff  time.Duration
+	MaxBackoff   time.Duration
+	// DisableAfter disables a webhook after this many consecutive failed
+	// attempts. Zero never disables.
+	DisableAfter int
+	// MaxInFlight caps concurrent deliveries per webhook.
+	MaxInFlight int
+	// BreakerThreshold consecutive failures open a webhook's circuit
+	// breaker for BreakerCooldown.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Workers:          4,
+		BatchSize:        50,
+		PollInterval:     2 * time.Second,
+		Lease:            2 * time.Minute,
+		MaxAttempts:      10,
+		BaseBackoff:      10 * time.Second,
+		MaxBackoff:       time.Hour,
+		DisableAfter:     50,
+		MaxInFlight:      2,
+		BreakerThreshold: 5,
+		BreakerCooldown:  30 * time.Second,
+	}
+}
+
+// Dispatcher delivers the webhook_deliveries outbox, retrying failed
+// attempts with exponential backoff.
+type Dispatcher struct {
+	db        *sql.DB
+	webhooks  *database.WebhookRegistry
+	cfg       Config
+	endpoints *endpoints
+}
+
+func NewDispatcher(db *sql.DB, webhooks *database.WebhookRegistry, cfg Config) *Dispatcher {
+	def := DefaultConfig()
+	if cfg.Workers <= 0 {
+		cfg.Workers = def.Workers
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = def.BatchSize
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = def.PollInterval
+	}
+	if cfg.Lease <= 0 {
+		cfg.Lease = def.Lease
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = def.MaxAttempts
+	}
+	if cfg.BaseBackoff <= 0 {
+		cfg.BaseBackoff = def.BaseBackoff
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = def.MaxBackoff
+	}
+	if cfg.MaxInFlight <= 0 {
+		cfg.MaxInFlight = def.MaxInFlight
+	}
+	if cfg.BreakerThreshold <= 0 {
+		cfg.BreakerThreshold = def.BreakerThreshold
+	}
+	if cfg.BreakerCooldown <= 0 {
+		cfg.BreakerCooldown = def.BreakerCooldown
+	}
+	// Breakers start closed again with a new dispatcher.
+	breakerStates.Init()
+	return &Dispatcher{
+		db:       db,
+		webhooks: webhooks,
+		cfg:      cfg,
+		endpoints: &endpoints{
+			maxInFlight: cfg.MaxInFlight,
+			threshold:   cfg.BreakerThreshold,
+			cooldown:    cfg.BreakerCooldown,
+			byID:        make(map[int]*endpoint),
+		},
+	}
+}
+
+func (d *Dispatcher) Run(ctx context.Context) {
+	log.Print("Webhook dispatcher started")
+	ticker := time.NewTicker(d.cfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		for {
+			n := d.dispatchBatch(ctx)
+			if n < d.cfg.BatchSize || ctx.Err() != nil {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			log.Print("Webhook dispatcher stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (d *Dispatcher) dispatchBatch(ctx context.Context) int {
+	deliveries, err := database.ClaimWebhookDeliveries(d.db, d.cfg.BatchSize, d.cfg.Lease)
+	if err != nil {
+		log.Printf("[webhooks] %v", err)
+		return 0
+	}
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, d.cfg.Workers)
+	for i := range deliveries {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(delivery *database.WebhookDelivery) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			d.deliver(delivery)
+		}(&deliveries[i])
+	}
+	wg.Wait()
+	return len(deliveries)
+}
+
+func (d *Dispatcher) deliver(delivery *database.WebhookDelivery) {
+	wh, err := d.webhook(delivery.WebhookID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			d.giveUp(delivery, database.DeliveryAttempt{Error: "webhook no longer exists"})
+			return
+		}
+		log.Printf("[webhooks] Couldn't load webhook %d for delivery %d: %v", delivery.WebhookID, delivery.ID, err)
+		return
+	}
+	if !wh.Enabled {
+		if err := database.CancelWebhookDeliveries(d.db, wh.ID, "webhook disabled"); err != nil {
+			log.Printf("[webhooks] %v", err)
+		}
+		return
+	}
+
+	body, contentType, err := render(wh, delivery.Payload)
+	if err != nil {
+		d.giveUp(delivery, database.DeliveryAttempt{Error: err.Error()})
+		return
+	}
+
+	ep := d.endpoints.get(wh.ID)
+	ok, wait := ep.acquire(time.Now())
+	if !ok {
+		if err := database.DeferDelivery(d.db, delivery, time.Now().Add(wait)); err != nil {
+			log.Printf("[webhooks] %v", err)
+		}
+		return
+	}
+
+	start := time.Now()
+	resp, err := api.SendWebhook(wh, delivery.EventID, contentType, body)
+	ep.release(err == nil, time.Now())
+	attempt := database.DeliveryAttempt{Latency: time.Since(start)}
+	if resp != nil {
+		attempt.StatusCode = &resp.StatusCode
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	if err := database.RecordDeliveryAttempt(d.db, delivery, attempt); err != nil {
+		log.Printf("[webhooks] %v", err)
+	}
+
+	if err == nil {
+		log.Printf("[webhooks] Delivered %s (delivery %d) to webhook %d in %s", delivery.Event, delivery.ID, wh.ID, attempt.Latency)
+		if err := database.MarkDeliveryDelivered(d.db, delivery, attempt); err != nil {
+			log.Printf("[webhooks] %v", err)
+		}
+		if err := database.ResetWebhookFailures(d.db, wh.ID); err != nil {
+			log.Printf("[webhooks] %v", err)
+		}
+		return
+	}
+
+	log.Printf("[webhooks] Delivery %d to webhook %d failed (attempt %d): %v", delivery.ID, wh.ID, delivery.Attempts, err)
+	disabled, failErr := database.RecordWebhookFailure(d.db, wh.ID, d.cfg.DisableAfter)
+	if failErr != nil {
+		log.Printf("[webhooks] %v", failErr)
+	}
+	if disabled {
+		log.Printf("[webhooks] Webhook %d (%s) disabled after %d consecutive failures", wh.ID, wh.Name, d.cfg.DisableAfter)
+	}
+
+	var denied *api.DeniedError
+	if errors.As(err, &denied) || delivery.Attempts >= d.cfg.MaxAttempts {
+		d.giveUp(delivery, attempt)
+		return
+	}
+	delay := d.backoff(delivery.Attempts)
+	if retryAfter, ok := api.RetryDelay(err); ok && retryAfter > delay {
+		delay = retryAfter
+	}
+	next := time.Now().Add(delay)
+	if err := database.MarkDeliveryRetry(d.db, delivery, attempt, &next); err != nil {
+		log.Printf("[webhooks] %v", err)
+	}
+	if disabled {
+		if err := database.CancelWebhookDeliveries(d.db, wh.ID, "webhook disabled"); err != nil {
+			log.Printf("[webhooks] %v", err)
+		}
+	}
+}
+
+// webhook reads from the registry, falling back to the database for webhooks
+// created since its last reload.
+func (d *Dispatcher) webhook(id int) (*api.Webhook, error) {
+	if wh, ok := d.webhooks.Get(id); ok {
+		return wh, nil
+	}
+	return database.GetWebhook(d.db, id)
+}
+
+func (d *Dispatcher) giveUp(delivery *database.WebhookDelivery, attempt database.DeliveryAttempt) {
+	log.Printf("[webhooks] Giving up on delivery %d after %d attempts: %s", delivery.ID, delivery.Attempts, attempt.Error)
+	if err := database.MarkDeliveryRetry(d.db, delivery, attempt, nil); err != nil {
+		log.Printf("[webhooks] %v", err)
+	}
+}
+
+// backoff returns BaseBackoff doubled for every previous attempt, capped at
+// MaxBackoff, with ±10% jitter.
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.cfg.BaseBackoff
+	for i := 1; i < attempts && delay < d.cfg.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > d.cfg.MaxBackoff {
+		delay = d.cfg.MaxBackoff
+	}
+	jitter := time.Duration(rand.Int63n(int64(delay)/5 + 1))
+	return delay - delay/10 + jitter
+}
+
+// render encodes a stored event for the webhook. Deliveries queued before
+// events were versioned hold a ready payload and are sent unchanged.
+func render(wh *api.Webhook, payload []byte) ([]byte, string, error) {
+	var ev api.Event
+	if err := json.Unmarshal(payload, &ev); err != nil {
+		return nil, "", fmt.Errorf("couldn't decode stored event: %w", err)
+	}
+	if ev.Version == "" {
+		return payload, "application/json", nil
+	}
+	return api.RenderEvent(wh, &ev)
+}
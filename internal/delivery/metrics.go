@@ -0,0 +1,36 @@
+package delivery
+
+import (
+	"expvar"
+	"strconv"
+)
+
+// Breaker metrics, published through expvar on /debug/vars when METRICS_ADDR
+// is set.
+var (
+	// breakerTransitions counts state changes by the state entered.
+	breakerTransitions = expvar.NewMap("webhook_breaker_transitions")
+	// breakerStates holds the current state of each webhook's breaker, keyed
+	// by webhook ID: 0 closed, 1 open, 2 half-open.
+	breakerStates = expvar.NewMap("webhook_breaker_state")
+)
+
+func init() {
+	// The number of breakers not currently closed.
+	expvar.Publish("webhook_breakers_tripped", expvar.Func(func() interface{} {
+		tripped := 0
+		breakerStates.Do(func(kv expvar.KeyValue) {
+			if state, ok := kv.Value.(*expvar.Int); ok && state.Value() != int64(breakerClosed) {
+				tripped++
+			}
+		})
+		return tripped
+	}))
+}
+
+func recordBreakerState(id int, state breakerState) {
+	breakerTransitions.Add(state.String(), 1)
+	value := new(expvar.Int)
+	value.Set(int64(state))
+	breakerStates.Set(strconv.Itoa(id), value)
+}
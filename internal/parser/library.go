@@ -5,12 +5,32 @@ import (
 )
 
 type Request struct {
-	Action  string            `json:"action"`
-	Method  string            `json:"method"`
-	Url     string            `json:"url"`
-	Headers map[string]string `json:"headers"`
-	Body    map[string]string `json:"body,omitempty"`
-	Params  map[string]string `json:"params,omitempty"`
+	Action   string            `json:"action"`
+	Method   string            `json:"method"`
+	Url      string            `json:"url"`
+	Headers  map[string]string `json:"headers"`
+	Body     json.RawMessage   `json:"body,omitempty"`
+	BodyType string            `json:"body_type,omitempty"`
+	Params   map[string]string `json:"params,omitempty"`
+	Files    []RequestFile     `json:"files,omitempty"`
+	Instance string            `json:"instance,omitempty"`
+}
+
+// Body types accepted in Request.BodyType. An empty BodyType means JSON.
+const (
+	BodyTypeJSON      = "json"
+	BodyTypeForm      = "form"
+	BodyTypeMultipart = "multipart"
+	BodyTypeRaw       = "raw"
+)
+
+// RequestFile is a multipart file part. Base64 may be a plain base64 string
+// or a data URI.
+type RequestFile struct {
+	Field       string `json:"field"`
+	FileName    string `json:"file_name"`
+	ContentType string `json:"content_type,omitempty"`
+	Base64      string `json:"base64"`
 }
 
 type Chat struct {
@@ -0,0 +1,139 @@
+// Package phone normalizes WhatsApp user JIDs so the same contact maps to a
+// single chat however its number was written. Each country registers a Rule
+// with its canonical national form and the other forms WhatsApp is known to
+// use for it.
+package phone
+
+import (
+	"sort"
+	"strings"
+)
+
+// Rule describes the numbering quirks of one country. Both functions receive
+// the national number, i.e. the digits after the calling code.
+type Rule struct {
+	Country     string
+	CallingCode string
+	// Canonical returns the national number as it appears in E.164.
+	Canonical func(national string) string
+	// Variants returns other national forms the same number is known by.
+	Variants func(national string) []string
+}
+
+var rules []Rule
+
+// Register adds or replaces the rule for r.CallingCode. Longer calling codes
+// are matched first.
+func Register(r Rule) {
+	for i := range rules {
+		if rules[i].CallingCode == r.CallingCode {
+			rules[i] = r
+			return
+		}
+	}
+	rules = append(rules, r)
+	sort.SliceStable(rules, func(i, j int) bool {
+		return len(rules[i].CallingCode) > len(rules[j].CallingCode)
+	})
+}
+
+// Digits strips formatting and the 00 international prefix from number.
+func Digits(number string) string {
+	var b strings.Builder
+	for _, r := range number {
+		if r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+	return strings.TrimPrefix(b.String(), "00")
+}
+
+func lookup(digits string) (*Rule, string) {
+	for i := range rules {
+		if strings.HasPrefix(digits, rules[i].CallingCode) {
+			return &rules[i], digits[len(rules[i].CallingCode):]
+		}
+	}
+	return nil, digits
+}
+
+// Canonical returns number in E.164 without the leading plus, the single form
+// chats are stored under. It is not necessarily the form WhatsApp uses in the
+// contact's JID, which may be one of the Variants, such as 521 for Mexican
+// mobiles or the eight-digit number of older Brazilian accounts. Numbers of
+// countries without a rule are only stripped of formatting.
+func Canonical(number string) string {
+	digits := Digits(number)
+	rule, national := lookup(digits)
+	if rule == nil || rule.Canonical == nil {
+		return digits
+	}
+	return rule.CallingCode + rule.Canonical(national)
+}
+
+// E164 returns number in E.164 format.
+func E164(number string) string {
+	return "+" + Canonical(number)
+}
+
+// Variants returns the digits of number, its canonical form and every other
+// known form, without duplicates.
+func Variants(number string) []string {
+	digits := Digits(number)
+	variants := []string{digits}
+	add := func(v string) {
+		for _, existing := range variants {
+			if existing == v {
+				return
+			}
+		}
+		variants = append(variants, v)
+	}
+	add(Canonical(digits))
+	if rule, national := lookup(digits); rule != nil && rule.Variants != nil {
+		for _, v := range rule.Variants(rule.Canonical(national)) {
+			add(rule.CallingCode + v)
+		}
+	}
+	return variants
+}
+
+// userDomains are the JID servers whose user part is a phone number. Group,
+// broadcast and LID JIDs are left untouched.
+var userDomains = map[string]bool{
+	"s.whatsapp.net": true,
+	"c.us":           true,
+}
+
+func splitJID(jid string) (string, string, bool) {
+	parts := strings.SplitN(jid, "@", 2)
+	if len(parts) != 2 || !userDomains[parts[1]] {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// NormalizeJID returns jid with its number in canonical form.
+func NormalizeJID(jid string) string {
+	number, domain, ok := splitJID(jid)
+	if !ok {
+		return jid
+	}
+	return Canonical(number) + "@" + domain
+}
+
+// JIDVariants returns jid and every other JID the same contact may be
+// stored under, jid itself first.
+func JIDVariants(jid string) []string {
+	number, domain, ok := splitJID(jid)
+	if !ok {
+		return []string{jid}
+	}
+	ids := []string{jid}
+	for _, v := range Variants(number) {
+		if id := v + "@" + domain; id != jid {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,109 @@
+package phone
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCanonical(t *testing.T) {
+	tests := []struct {
+		name   string
+		number string
+		want   string
+	}{
+		{"BR mobile with 8 digits", "551187654321", "5511987654321"},
+		{"BR mobile with 9 digits", "5511987654321", "5511987654321"},
+		{"BR landline", "551133334444", "551133334444"},
+		{"BR formatted", "+55 (11) 8765-4321", "5511987654321"},
+		{"BR with 00 prefix", "0055 11 8765-4321", "5511987654321"},
+		{"AR mobile without 9", "541123456789", "5491123456789"},
+		{"AR mobile with 9", "5491123456789", "5491123456789"},
+		{"MX with 1 prefix", "5215512345678", "525512345678"},
+		{"MX without 1 prefix", "525512345678", "525512345678"},
+		{"PT", "351912345678", "351912345678"},
+		{"PT with 00 prefix", "00351 912 345 678", "351912345678"},
+		{"country without a rule", "14155552671", "14155552671"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Canonical(tt.number); got != tt.want {
+				t.Errorf("Canonical(%q) = %q, want %q", tt.number, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVariants(t *testing.T) {
+	tests := []struct {
+		name   string
+		number string
+		want   []string
+	}{
+		{"BR mobile with 8 digits", "551187654321", []string{"551187654321", "5511987654321"}},
+		{"BR mobile with 9 digits", "5511987654321", []string{"5511987654321", "551187654321"}},
+		// Landlines keep the 9-prefixed form stored by older versions.
+		{"BR landline", "551133334444", []string{"551133334444", "5511933334444"}},
+		{"BR with 00 prefix", "0055 11 98765-4321", []string{"5511987654321", "551187654321"}},
+		{"AR mobile without 9", "541123456789", []string{"541123456789", "5491123456789"}},
+		{"AR mobile with 9", "5491123456789", []string{"5491123456789", "541123456789"}},
+		{"MX with 1 prefix", "5215512345678", []string{"5215512345678", "525512345678"}},
+		{"MX without 1 prefix", "525512345678", []string{"525512345678", "5215512345678"}},
+		{"PT", "351912345678", []string{"351912345678"}},
+		{"country without a rule", "14155552671", []string{"14155552671"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Variants(tt.number); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Variants(%q) = %q, want %q", tt.number, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeJID(t *testing.T) {
+	tests := []struct {
+		name string
+		jid  string
+		want string
+	}{
+		{"BR mobile with 8 digits", "551187654321@s.whatsapp.net", "5511987654321@s.whatsapp.net"},
+		{"BR landline", "551133334444@s.whatsapp.net", "551133334444@s.whatsapp.net"},
+		{"AR mobile without 9", "541123456789@s.whatsapp.net", "5491123456789@s.whatsapp.net"},
+		{"MX with 1 prefix", "5215512345678@c.us", "525512345678@c.us"},
+		{"PT", "351912345678@s.whatsapp.net", "351912345678@s.whatsapp.net"},
+		{"group", "120363025246125486@g.us", "120363025246125486@g.us"},
+		{"LID", "187654321012345@lid", "187654321012345@lid"},
+		{"broadcast", "status@broadcast", "status@broadcast"},
+		{"bare number", "551187654321", "551187654321"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NormalizeJID(tt.jid); got != tt.want {
+				t.Errorf("NormalizeJID(%q) = %q, want %q", tt.jid, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJIDVariants(t *testing.T) {
+	tests := []struct {
+		name string
+		jid  string
+		want []string
+	}{
+		{"BR mobile with 9 digits", "5511987654321@s.whatsapp.net", []string{"5511987654321@s.whatsapp.net", "551187654321@s.whatsapp.net"}},
+		{"BR mobile with 8 digits", "551187654321@s.whatsapp.net", []string{"551187654321@s.whatsapp.net", "5511987654321@s.whatsapp.net"}},
+		{"AR mobile with 9", "5491123456789@s.whatsapp.net", []string{"5491123456789@s.whatsapp.net", "541123456789@s.whatsapp.net"}},
+		{"MX without 1 prefix", "525512345678@c.us", []string{"525512345678@c.us", "5215512345678@c.us"}},
+		{"PT", "351912345678@s.whatsapp.net", []string{"351912345678@s.whatsapp.net"}},
+		{"group", "120363025246125486@g.us", []string{"120363025246125486@g.us"}},
+		{"LID", "187654321012345@lid", []string{"187654321012345@lid"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := JIDVariants(tt.jid); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("JIDVariants(%q) = %q, want %q", tt.jid, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package phone
+
+func init() {
+	Register(Rule{Country: "BR", CallingCode: "55", Canonical: brazilCanonical, Variants: brazilVariants})
+	Register(Rule{Country: "AR", CallingCode: "54", Canonical: argentinaCanonical, Variants: argentinaVariants})
+	Register(Rule{Country: "MX", CallingCode: "52", Canonical: mexicoCanonical, Variants: mexicoVariants})
+	Register(Rule{Country: "PT", CallingCode: "351", Canonical: portugalCanonical})
+}
+
+// Brazil: two-digit area code followed by a nine-digit mobile number starting
+// with 9. Older WhatsApp accounts still use the eight-digit mobile number.
+// Landlines keep eight digits, but earlier versions of this service stored
+// them with a 9 prepended, so that form is kept as a variant.
+func brazilCanonical(national string) string {
+	if len(national) == 10 && national[2] >= '6' {
+		return national[:2] + "9" + national[2:]
+	}
+	return national
+}
+
+func brazilVariants(national string) []string {
+	switch {
+	case len(national) == 11 && national[2] == '9':
+		return []string{national[:2] + national[3:]}
+	case len(national) == 10:
+		return []string{national[:2] + "9" + national[2:]}
+	}
+	return nil
+}
+
+// Argentina: mobiles are dialled internationally as 54 9 + ten digits, which
+// is also how WhatsApp reports them, but they are often written without the
+// 9. Landlines can't be told apart from mobiles missing the 9, so ten-digit
+// numbers are assumed to be mobiles.
+func argentinaCanonical(national string) string {
+	if len(national) == 10 {
+		return "9" + national
+	}
+	return national
+}
+
+func argentinaVariants(national string) []string {
+	if len(national) == 11 && national[0] == '9' {
+		return []string{national[1:]}
+	}
+	return nil
+}
+
+// Mexico: the 1 mobile prefix was dropped from dialling in 2019, but WhatsApp
+// still reports mobile JIDs with it, so both forms occur.
+func mexicoCanonical(national string) string {
+	if len(national) == 11 && national[0] == '1' {
+		return national[1:]
+	}
+	return national
+}
+
+func mexicoVariants(national string) []string {
+	if len(national) == 10 {
+		return []string{"1" + national}
+	}
+	return nil
+}
+
+// Portugal: nine-digit national numbers with no trunk prefix; duplicates only
+// come from formatting, which Digits already removes.
+func portugalCanonical(national string) string {
+	return national
+}
@@ -0,0 +1,86 @@
+package process
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"wasolgo/internal/database"
+)
+
+var batchActions = map[string]string{
+	"upsertchat":     "upsertChat",
+	"upsertcustomer": "upsertCustomer",
+	"sendmessage":    "sendMessage",
+	"upsertmessage":  "upsertMessage",
+}
+
+type BatchItem struct {
+	Action string          `json:"action"`
+	Body   json.RawMessage `json:"body"`
+}
+
+type BatchItemResult struct {
+	Index  int    `json:"index"`
+	Action string `json:"action"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+const (
+	BatchStatusOK         = "ok"
+	BatchStatusFailed     = "failed"
+	BatchStatusRolledBack = "rolled_back"
+	BatchStatusSkipped    = "skipped"
+)
+
+// processBatch runs every item of a batch inside a single transaction. Items
+// are executed in order and the first failure rolls back the whole batch.
+func processBatch(client *sql.DB, bodyBytes []byte) ([]BatchItem, []BatchItemResult, error) {
+	var items []BatchItem
+	if err := json.Unmarshal(bodyBytes, &items); err != nil {
+		return nil, nil, fmt.Errorf("failed to unmarshal batch body: %w", err)
+	}
+	if len(items) == 0 {
+		return nil, nil, fmt.Errorf("batch has no items")
+	}
+
+	results := make([]BatchItemResult, len(items))
+	for i, item := range items {
+		results[i] = BatchItemResult{Index: i, Action: item.Action, Status: BatchStatusSkipped}
+	}
+
+	failed := -1
+	err := database.WithTx(client, func(tx *sql.Tx) error {
+		for i, item := range items {
+			action, ok := batchActions[strings.ToLower(item.Action)]
+			if !ok {
+				failed = i
+				return fmt.Errorf("item %d: action %q is not allowed in a batch", i, item.Action)
+			}
+			if len(item.Body) == 0 || string(item.Body) == "null" {
+				failed = i
+				return fmt.Errorf("item %d: missing 'body' field", i)
+			}
+			if err := runDbAction(tx, action, item.Body); err != nil {
+				failed = i
+				return fmt.Errorf("item %d: %w", i, err)
+			}
+			results[i].Status = BatchStatusOK
+		}
+		return nil
+	})
+	if err != nil {
+		for i := range results {
+			switch {
+			case i == failed:
+				results[i].Status = BatchStatusFailed
+				results[i].Error = err.Error()
+			case results[i].Status == BatchStatusOK:
+				results[i].Status = BatchStatusRolledBack
+			}
+		}
+		return items, results, err
+	}
+	return items, results, nil
+}
@@ -0,0 +1,207 @@
+package process
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"wasolgo/internal/api"
+	"wasolgo/internal/archive"
+	"wasolgo/internal/chatstore"
+	"wasolgo/internal/database"
+)
+
+type chatActionBody struct {
+	ChatID      string  `json:"chat_id"`
+	PerformedBy string  `json:"performed_by"`
+	AgentID     *string `json:"agent_id,omitempty"`
+	Department  *string `json:"department,omitempty"`
+	Tabulation  *string `json:"tabulation,omitempty"`
+}
+
+// processChatAction applies closeChat, transferChat and tabulateChat to both
+// the chats table and the chat header in the store. Actions that would move
+// the chat through a transition the lifecycle doesn't allow are rejected,
+// checked atomically with the header update. The Postgres transaction is only
+// committed once the store has been updated, and the fields it wrote are
+// reverted if the commit fails. Chats missing from the store are only updated
+// in Postgres.
+func processChatAction(client *sql.DB, registry *database.WebhookRegistry, store chatstore.Store, action string, bodyBytes []byte) error {
+	var body chatActionBody
+	if err := json.Unmarshal(bodyBytes, &body); err != nil {
+		return fmt.Errorf("failed to unmarshal %s body: %w", action, err)
+	}
+	if body.ChatID == "" {
+		return fmt.Errorf("%s requires chat_id", action)
+	}
+	if body.PerformedBy == "" {
+		return fmt.Errorf("%s requires performed_by", action)
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	var fields map[string]interface{}
+	var event, situation string
+	details := map[string]interface{}{}
+
+	switch action {
+	case "closeChat":
+		event = api.EventChatClosed
+		situation = chatstore.SituationFinished
+		fields = map[string]interface{}{
+			"closed_by": body.PerformedBy,
+			"closed_at": now,
+		}
+		if body.Tabulation != nil {
+			fields["tabulation"] = *body.Tabulation
+			details["tabulation"] = *body.Tabulation
+		}
+	case "transferChat":
+		if body.AgentID == nil && body.Department == nil {
+			return fmt.Errorf("transferChat requires agent_id or department")
+		}
+		event = api.EventChatTransferred
+		situation = chatstore.SituationEnqueued
+		if body.AgentID != nil && *body.AgentID != "" {
+			situation = chatstore.SituationAssigned
+		}
+		fields = map[string]interface{}{
+			"agent_id":       body.AgentID,
+			"transferred_by": body.PerformedBy,
+			"transferred_at": now,
+		}
+		if body.Department != nil {
+			fields["department"] = *body.Department
+		}
+		details["agent_id"] = body.AgentID
+		details["department"] = body.Department
+	case "tabulateChat":
+		if body.Tabulation == nil || *body.Tabulation == "" {
+			return fmt.Errorf("tabulateChat requires tabulation")
+		}
+		event = api.EventChatTabulated
+		fields = map[string]interface{}{
+			"tabulation":   *body.Tabulation,
+			"tabulated_by": body.PerformedBy,
+			"tabulated_at": now,
+		}
+		details["tabulation"] = *body.Tabulation
+	default:
+		return fmt.Errorf("action %q is not supported", action)
+	}
+
+	ctx := context.Background()
+	var previous, written map[string]interface{}
+	err := database.WithTx(client, func(tx *sql.Tx) error {
+		var err error
+		if situation != "" {
+			previous, written, err = chatstore.Transition(ctx, store, body.ChatID, situation, fields)
+		} else {
+			previous, err = store.UpdateChat(ctx, body.ChatID, fields)
+			written = fields
+		}
+		if errors.Is(err, chatstore.ErrNotFound) {
+			log.Printf("Chat %s isn't in the store, applying %s to the database only", body.ChatID, action)
+		} else if err != nil {
+			return fmt.Errorf("couldn't update chat in store: %w", err)
+		}
+
+		switch action {
+		case "closeChat":
+			err = database.CloseChat(tx, body.ChatID, body.Tabulation)
+		case "transferChat":
+			err = database.TransferChat(tx, body.ChatID, body.AgentID, body.Department, situation)
+		case "tabulateChat":
+			err = database.TabulateChat(tx, body.ChatID, *body.Tabulation)
+		}
+		if err != nil {
+			return err
+		}
+		return database.InsertChatAction(tx, body.ChatID, action, body.PerformedBy, details)
+	})
+	if err != nil {
+		if previous != nil {
+			if restoreErr := chatstore.Revert(ctx, store, body.ChatID, previous, written); restoreErr != nil {
+				log.Printf("[ERROR] Couldn't restore chat %s after failed %s: %v", body.ChatID, action, restoreErr)
+			}
+		}
+		return fmt.Errorf("error on %s: %w", action, err)
+	}
+	fmt.Printf("Successfully applied %s to chat %s!", action, body.ChatID)
+
+	ev := chatEvent(ctx, store, event, body.ChatID)
+	ev.PerformedBy = body.PerformedBy
+	notifyWebhooks(client, registry, ev)
+	return nil
+}
+
+// SyncChatState mirrors a situation change made in the store to the chats
+// table. The message that caused it is already stored, so failures are
+// logged rather than failing its delivery; chats without a row are skipped.
+func SyncChatState(db *sql.DB, chatID string, change *chatstore.Change) {
+	if db == nil || change == nil {
+		return
+	}
+	err := database.SetChatState(db, chatID, change.Fields)
+	if err != nil && !errors.Is(err, database.ErrChatNotFound) {
+		log.Printf("[ERROR] Couldn't mirror situation %s of chat %s to the database: %v", change.To, chatID, err)
+	}
+}
+
+// processMarkRead resets the unread counter of a chat once an agent has seen
+// it.
+func processMarkRead(store chatstore.Store, bodyBytes []byte) error {
+	var body chatActionBody
+	if err := json.Unmarshal(bodyBytes, &body); err != nil {
+		return fmt.Errorf("failed to unmarshal markRead body: %w", err)
+	}
+	if body.ChatID == "" {
+		return fmt.Errorf("markRead requires chat_id")
+	}
+	if err := store.MarkRead(context.Background(), body.ChatID); err != nil {
+		return fmt.Errorf("error on markRead: %w", err)
+	}
+	fmt.Printf("Marked chat %s as read", body.ChatID)
+	return nil
+}
+
+type chatHistoryBody struct {
+	ChatID string `json:"chat_id"`
+	Before *int64 `json:"before,omitempty"`
+	Limit  int64  `json:"limit,omitempty"`
+}
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 500
+)
+
+// processChatHistory returns a page of a chat's messages, including those
+// already archived out of Redis, as the reply of the delivery.
+func processChatHistory(client *sql.DB, store chatstore.Store, bodyBytes []byte) (*archive.HistoryPage, error) {
+	var body chatHistoryBody
+	if err := json.Unmarshal(bodyBytes, &body); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal chatHistory body: %w", err)
+	}
+	if body.ChatID == "" {
+		return nil, fmt.Errorf("chatHistory requires chat_id")
+	}
+	before := int64(-1)
+	if body.Before != nil {
+		before = *body.Before
+	}
+	if body.Limit <= 0 {
+		body.Limit = defaultHistoryLimit
+	}
+	if body.Limit > maxHistoryLimit {
+		body.Limit = maxHistoryLimit
+	}
+	page, err := archive.History(context.Background(), client, store, body.ChatID, before, body.Limit)
+	if err != nil {
+		return nil, fmt.Errorf("error on chatHistory: %w", err)
+	}
+	return page, nil
+}
@@ -5,14 +5,15 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"log"
 	"strings"
 
 	redis "wasolgo/internal/redis"
 
 	"wasolgo/internal/api"
+	"wasolgo/internal/chatstore"
 
 	amqp "github.com/rabbitmq/amqp091-go"
-	rdb "github.com/redis/go-redis/v9"
 
 	"wasolgo/internal/database"
 	"wasolgo/internal/parser"
@@ -33,7 +34,27 @@ func getStringPointer(m map[string]interface{}, path ...string) (string, bool) {
 	return "", false
 }
 
-func ProcessIncoming(delivery amqp.Delivery, rdb *rdb.Client, db *sql.DB) error {
+// messageMedia reads the media reference of an Evolution message; the base64
+// content is left out.
+func messageMedia(data map[string]interface{}, kind string) *api.EventMedia {
+	media := &api.EventMedia{}
+	media.MimeType, _ = getStringPointer(data, "message", kind, "mimetype")
+	media.FileName, _ = getStringPointer(data, "message", kind, "fileName")
+	media.Url, _ = getStringPointer(data, "message", kind, "url")
+	return media
+}
+
+func eventMessageType(msgType string) string {
+	switch msgType {
+	case "conversation", "extendedTextMessage":
+		return "text"
+	case "documentMessage":
+		return "document"
+	}
+	return msgType
+}
+
+func ProcessIncoming(delivery amqp.Delivery, store chatstore.Store, db *sql.DB, registry *database.WebhookRegistry) error {
 	message := string(delivery.Body)
 	fmt.Printf("Received message: %s", message)
 
@@ -57,8 +78,7 @@ func ProcessIncoming(delivery amqp.Delivery, rdb *rdb.Client, db *sql.DB) error
 
 	isContact := value["name"] != nil && value["number"] != nil && value["created_at"] != nil
 
-	var chatMetadataString string
-	var chatMetadata *string
+	var header map[string]interface{}
 	if isContact {
 		contact := make(map[string]interface{})
 		for k, v := range value {
@@ -73,9 +93,10 @@ func ProcessIncoming(delivery amqp.Delivery, rdb *rdb.Client, db *sql.DB) error
 				}
 			}
 		}
-		b, _ := json.Marshal(contact)
-		chatMetadataString = string(b)
-		chatMetadata = &chatMetadataString
+		header = contact
+	} else {
+		apikey, _ := getStringPointer(value, "apikey")
+		header = redis.NewChatHeader(chatID, remoteJid, apikey)
 	}
 
 	var (
@@ -87,6 +108,7 @@ func ProcessIncoming(delivery amqp.Delivery, rdb *rdb.Client, db *sql.DB) error
 		msgType   string
 		timestamp string
 		extension string
+		media     *api.EventMedia
 	)
 	if data, ok := value["data"].(map[string]interface{}); ok {
 		msgID, _ = getStringPointer(data, "key", "id")
@@ -109,11 +131,13 @@ func ProcessIncoming(delivery amqp.Delivery, rdb *rdb.Client, db *sql.DB) error
 			base64, _ := getStringPointer(data, "message", "base64")
 			body = "data:image/png;base64," + base64
 			text = "📷 Imagem enviada"
+			media = messageMedia(data, "imageMessage")
 		case "audioMessage":
 			msgType = "audio"
 			base64, _ := getStringPointer(data, "message", "base64")
 			body = "data:audio/ogg;base64," + base64
 			text = "Áudio enviado"
+			media = messageMedia(data, "audioMessage")
 		case "documentMessage":
 			base64, _ := getStringPointer(data, "message", "base64")
 			fileName, _ := getStringPointer(data, "message", "documentMessage", "fileName")
@@ -124,6 +148,8 @@ func ProcessIncoming(delivery amqp.Delivery, rdb *rdb.Client, db *sql.DB) error
 					extension = fileName[dot+1:]
 				}
 			}
+			media = messageMedia(data, "documentMessage")
+			media.Extension = extension
 		}
 	}
 
@@ -141,42 +167,16 @@ func ProcessIncoming(delivery amqp.Delivery, rdb *rdb.Client, db *sql.DB) error
 	}
 	messageJSON, _ := json.Marshal(normalized)
 
-	var messageBytes []byte
-	if valueBytes, err := json.Marshal(value); err == nil {
-		messageBytes = valueBytes
-	}
-
-	{
-		ctx := context.Background()
-		existingChatID, err := redis.FindExistingChatID(ctx, rdb, chatID)
-		if err == nil {
-			chatKey := "chat:" + existingChatID
-			chatJSON, err := rdb.LIndex(ctx, chatKey, 0).Result()
-			if err == nil {
-				var chatObj map[string]interface{}
-				if err := json.Unmarshal([]byte(chatJSON), &chatObj); err == nil {
-					situation, _ := chatObj["situation"].(string)
-					isActive, _ := chatObj["is_active"].(bool)
-					if situation == "finished" || !isActive {
-						_ = redis.UpdateChatToOpen(ctx, rdb, chatID)
-					}
-				}
-			}
-		}
+	change, err := chatstore.CustomerMessage(context.Background(), store, chatID)
+	if err != nil {
+		log.Printf("[ERROR] Couldn't update situation of chat %s: %v", chatID, err)
 	}
 
-	err := redis.InsertMessageToChat(
-		context.Background(),
-		rdb,
-		chatID,
-		string(messageJSON),
-		remoteJid,
-		chatMetadata,
-		&messageBytes,
-	)
+	storedChatID, _, err := store.AppendMessage(context.Background(), chatID, string(messageJSON), true, header)
 	if err != nil {
 		return fmt.Errorf("failed to insert message to chat: %w", err)
 	}
+	log.Printf("Successfully inserted message for chat:%s", storedChatID)
 
 	msg := parser.Message{
 		From:   from,
@@ -189,59 +189,39 @@ func ProcessIncoming(delivery amqp.Delivery, rdb *rdb.Client, db *sql.DB) error
 		if dbErr != nil {
 			return fmt.Errorf("failed to insert message into database: %w", dbErr)
 		}
+		SyncChatState(db, storedChatID, change)
 
-		webhooks, err := database.GetAllWebhooks(db)
-		if err != nil {
-			fmt.Printf("[DEBUG] Failed to get webhooks: %v", err)
-		} else if webhooks == nil || len(*webhooks) == 0 {
-			fmt.Printf("[DEBUG] No webhooks configured")
-		} else {
-			fmt.Printf("[DEBUG] Found %d webhooks", len(*webhooks))
-			ctx := context.Background()
-			var department, agent, tag string
-			var isOpen bool
-			if chatInfo, err := redis.GetChat(ctx, rdb, chatID); err == nil {
-				if dep, ok := chatInfo["department"].(string); ok {
-					department = dep
-				}
-				if ag, ok := chatInfo["agent_id"].(string); ok {
-					agent = ag
-				}
-				if tg, ok := chatInfo["tags"].(string); ok {
-					tag = tg
-				}
-				if open, ok := chatInfo["is_active"].(bool); ok {
-					isOpen = open
-				}
-			}
-			connID, _ := getStringPointer(value, "instance_id")
-			if connID == "" {
-				connID, _ = getStringPointer(value, "data", "instanceId")
-			}
-			payload := api.WebhookMessage{
-				Conn:       connID,
-				Message:    text,
-				SentBy:     from,
-				Department: department,
-				Agent:      agent,
-				Tag:        tag,
-				IsOpen:     isOpen,
-			}
-			webhookSent := false
-			for _, wh := range *webhooks {
-				if wh.ReceiveMessage {
-					if wh.Conn != nil && connID != "" && *wh.Conn != connID && !wh.IsGlobal {
-						fmt.Printf("[DEBUG] Webhook filtered out: conn mismatch (webhook: %s, message: %s)", *wh.Conn, connID)
-						continue
-					}
-					fmt.Printf("[DEBUG] Sending webhook to: %s", wh.Url)
-					go api.SendWebhook(wh.Url, &payload)
-					webhookSent = true
-				}
-			}
-			if !webhookSent {
-				fmt.Printf("[DEBUG] No webhooks were sent (all filtered out or not configured for message)")
+		connID, _ := getStringPointer(value, "instance_id")
+		if connID == "" {
+			connID, _ = getStringPointer(value, "data", "instanceId")
+		}
+		if change.Reopened() {
+			reopenEv := chatEvent(context.Background(), store, api.EventChatReopened, chatID)
+			reopenEv.Instance = connID
+			notifyWebhooks(db, registry, reopenEv)
+		}
+
+		ev := chatEvent(context.Background(), store, api.EventMessageReceived, chatID)
+		ev.Instance = connID
+		ev.Message = &api.EventMessage{
+			ID:        msgID,
+			Direction: "inbound",
+			Type:      eventMessageType(msgType),
+			Text:      text,
+			From:      from,
+			To:        to,
+			Timestamp: timestamp,
+			Media:     media,
+		}
+		if pushName, ok := getStringPointer(value, "data", "pushName"); ok && pushName != "" {
+			if ev.Customer == nil {
+				ev.Customer = &api.EventCustomer{}
 			}
+			ev.Customer.Name = pushName
+		}
+		webhookSent := notifyWebhooks(db, registry, ev)
+		if !webhookSent {
+			fmt.Printf("[DEBUG] No webhooks were sent (all filtered out or not configured for message)")
 		}
 	} else {
 		fmt.Printf("[DEBUG] Database is nil, skipping webhook logic")
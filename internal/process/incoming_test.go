@@ -0,0 +1,129 @@
+package process
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"wasolgo/internal/chatstore"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func upsertDelivery(t *testing.T, remoteJid, id, text string) amqp.Delivery {
+	t.Helper()
+	body, err := json.Marshal(map[string]interface{}{
+		"event":     "messages.upsert",
+		"sender":    "5511900000000@s.whatsapp.net",
+		"apikey":    "instance-1",
+		"date_time": "2026-01-02T15:04:05.000Z",
+		"data": map[string]interface{}{
+			"key":         map[string]interface{}{"remoteJid": remoteJid, "id": id},
+			"message":     map[string]interface{}{"conversation": text},
+			"messageType": "conversation",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return amqp.Delivery{Body: body}
+}
+
+func TestProcessIncoming(t *testing.T) {
+	tests := []struct {
+		name string
+		// existing is stored before the message arrives, under existingID.
+		existingID string
+		existing   map[string]interface{}
+		remoteJid  string
+
+		wantChatID    string
+		wantSituation string
+		wantAgent     interface{}
+	}{
+		{
+			name:          "new chat",
+			remoteJid:     "5511987654321@s.whatsapp.net",
+			wantChatID:    "5511987654321@s.whatsapp.net",
+			wantSituation: chatstore.SituationEnqueued,
+		},
+		{
+			name:          "8-digit sender of an existing chat",
+			existingID:    "5511987654321@s.whatsapp.net",
+			existing:      map[string]interface{}{"situation": chatstore.SituationAssigned, "is_active": true, "agent_id": "agent-1"},
+			remoteJid:     "551187654321@s.whatsapp.net",
+			wantChatID:    "5511987654321@s.whatsapp.net",
+			wantSituation: chatstore.SituationAssigned,
+			wantAgent:     "agent-1",
+		},
+		{
+			name:          "waiting for the customer",
+			existingID:    "5511987654321@s.whatsapp.net",
+			existing:      map[string]interface{}{"situation": chatstore.SituationWaitingCustomer, "is_active": true, "agent_id": "agent-1"},
+			remoteJid:     "5511987654321@s.whatsapp.net",
+			wantChatID:    "5511987654321@s.whatsapp.net",
+			wantSituation: chatstore.SituationInProgress,
+			wantAgent:     "agent-1",
+		},
+		{
+			name:          "finished chat is requeued",
+			existingID:    "5511987654321@s.whatsapp.net",
+			existing:      map[string]interface{}{"situation": chatstore.SituationFinished, "is_active": false, "agent_id": "agent-1", "department": "vendas"},
+			remoteJid:     "5511987654321@s.whatsapp.net",
+			wantChatID:    "5511987654321@s.whatsapp.net",
+			wantSituation: chatstore.SituationEnqueued,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := chatstore.NewMemory()
+			if tt.existing != nil {
+				tt.existing["id"] = tt.existingID
+				if _, _, err := store.EnsureChat(ctx, tt.existingID, tt.existing); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := ProcessIncoming(upsertDelivery(t, tt.remoteJid, "ABC", "oi"), store, nil, nil); err != nil {
+				t.Fatalf("ProcessIncoming: %v", err)
+			}
+
+			chatID, found, err := store.FindChat(ctx, tt.remoteJid)
+			if err != nil || !found {
+				t.Fatalf("FindChat(%s) = %v, %v", tt.remoteJid, found, err)
+			}
+			if chatID != tt.wantChatID {
+				t.Errorf("chat ID = %s, want %s", chatID, tt.wantChatID)
+			}
+			messages, err := store.ListMessages(ctx, chatID, 0, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(messages) != 1 {
+				t.Fatalf("got %d messages, want 1", len(messages))
+			}
+			var msg map[string]interface{}
+			if err := json.Unmarshal([]byte(messages[0]), &msg); err != nil {
+				t.Fatal(err)
+			}
+			if msg["id"] != "msg_ABC" || msg["text"] != "oi" {
+				t.Errorf("stored message = %s", messages[0])
+			}
+
+			header, err := store.GetChat(ctx, chatID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := chatstore.Situation(header); got != tt.wantSituation {
+				t.Errorf("situation = %s, want %s", got, tt.wantSituation)
+			}
+			if header["agent_id"] != tt.wantAgent {
+				t.Errorf("agent_id = %v, want %v", header["agent_id"], tt.wantAgent)
+			}
+			if header["unread"] != float64(1) {
+				t.Errorf("unread = %v, want 1", header["unread"])
+			}
+		})
+	}
+}
@@ -3,12 +3,16 @@ package process
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 	"wasolgo/internal/api"
+	"wasolgo/internal/chatstore"
 	"wasolgo/internal/database"
 	"wasolgo/internal/parser"
+	redis "wasolgo/internal/redis"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 )
@@ -50,44 +54,109 @@ func getInt(m map[string]interface{}, key string) int {
 	return 0
 }
 
-func ProcessOutgoing(delivery amqp.Delivery, client *sql.DB) error {
+type SendRequestResult struct {
+	Status   string        `json:"status"`
+	Response *api.Response `json:"response,omitempty"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// ProcessOutgoing handles a delivery from the outgoing_requests queue. The
+// returned value, when not nil, is sent back to the delivery's reply_to queue.
+func ProcessOutgoing(delivery amqp.Delivery, client *sql.DB, registry *database.WebhookRegistry, store chatstore.Store) (interface{}, error) {
 	message := string(delivery.Body)
 	fmt.Printf("Received message: %s", message)
 
 	var envelope map[string]interface{}
 	if err := json.Unmarshal(delivery.Body, &envelope); err != nil {
-		return fmt.Errorf("failed to unmarshal envelope: %w", err)
+		return nil, fmt.Errorf("failed to unmarshal envelope: %w", err)
 	}
 
 	bodyRaw, ok := envelope["body"]
 	if !ok {
-		return fmt.Errorf("missing 'body' field in message: %s", message)
+		return nil, fmt.Errorf("missing 'body' field in message: %s", message)
 	}
 
 	bodyBytes, err := json.Marshal(bodyRaw)
 	if err != nil {
-		return fmt.Errorf("failed to marshal body field: %w", err)
+		return nil, fmt.Errorf("failed to marshal body field: %w", err)
 	}
 
 	action := strings.ToLower(getString(envelope, "action"))
 	msgType := strings.ToLower(getString(envelope, "type"))
 
+	if action == "batch" {
+		fmt.Print("Starting Batch process...")
+		items, results, err := processBatch(client, bodyBytes)
+		if err != nil {
+			return results, fmt.Errorf("error on processing batch: %w", err)
+		}
+		for _, item := range items {
+			if strings.EqualFold(item.Action, "sendMessage") {
+				notifyStoredMessage(client, registry, store, item.Body)
+			}
+		}
+		fmt.Printf("Successfully committed batch of %d actions!", len(results))
+		return results, nil
+	}
+
+	switch action {
+	case "closechat":
+		return nil, processChatAction(client, registry, store, "closeChat", bodyBytes)
+	case "transferchat":
+		return nil, processChatAction(client, registry, store, "transferChat", bodyBytes)
+	case "tabulatechat":
+		return nil, processChatAction(client, registry, store, "tabulateChat", bodyBytes)
+	case "markread":
+		return nil, processMarkRead(store, bodyBytes)
+	case "chathistory":
+		page, err := processChatHistory(client, store, bodyBytes)
+		if err != nil {
+			return nil, err
+		}
+		return page, nil
+	}
+
 	if msgType == "sendrequest" || action == "sendmessage" {
 		fmt.Print("Starting SendRequest process...")
 		var req parser.Request
 		if err := json.Unmarshal(delivery.Body, &req); err != nil {
-			return fmt.Errorf("failed to unmarshal SendRequest message: %w", err)
+			return nil, fmt.Errorf("failed to unmarshal SendRequest message: %w", err)
 		}
-		err := api.SendRequest(&req)
+		resp, err := api.SendRequest(&req)
 		if err != nil {
-			return fmt.Errorf("error on sending request: %w", err)
+			result := &SendRequestResult{Status: "failed", Response: resp, Error: err.Error()}
+			var denied *api.DeniedError
+			if errors.As(err, &denied) {
+				result.Status = "denied"
+			}
+			return result, fmt.Errorf("error on sending request: %w", err)
 		} else {
 			fmt.Print("Successfully sent request!")
-			return nil
+			notifySentRequest(client, registry, store, &req, resp)
+			return &SendRequestResult{Status: "ok", Response: resp}, nil
+		}
+	}
+
+	switch {
+	case strings.Contains(message, "upsertChat"):
+		return nil, runDbAction(client, "upsertChat", bodyBytes)
+	case strings.Contains(message, "upsertCustomer"):
+		return nil, runDbAction(client, "upsertCustomer", bodyBytes)
+	case strings.Contains(message, "sendMessage"):
+		if err := runDbAction(client, "sendMessage", bodyBytes); err != nil {
+			return nil, err
 		}
+		notifyStoredMessage(client, registry, store, bodyBytes)
+		return nil, nil
+	case strings.Contains(message, "upsertMessage"):
+		return nil, runDbAction(client, "upsertMessage", bodyBytes)
 	}
+	return nil, fmt.Errorf("unknown message type. Message content: %s", message)
+}
 
-	if strings.Contains(message, "upsertChat") {
+func runDbAction(exec database.Executor, action string, bodyBytes []byte) error {
+	switch action {
+	case "upsertChat":
 		fmt.Print("Starting UpsertChat process...")
 		var chatMap map[string]interface{}
 		if err := json.Unmarshal(bodyBytes, &chatMap); err != nil {
@@ -107,14 +176,12 @@ func ProcessOutgoing(delivery amqp.Delivery, client *sql.DB) error {
 			chat.Tabulation = &tab
 		}
 
-		err := database.UpsertChat(client, &chat)
-		if err != nil {
+		if err := database.UpsertChat(exec, &chat); err != nil {
 			return fmt.Errorf("error on upserting chat into the db: %w", err)
-		} else {
-			fmt.Print("Successfully inserted chat into db!")
-			return nil
 		}
-	} else if strings.Contains(message, "upsertCustomer") {
+		fmt.Print("Successfully inserted chat into db!")
+		return nil
+	case "upsertCustomer":
 		fmt.Print("Starting UpsertCustomer process...")
 		var customer parser.Customer
 		if err := json.Unmarshal(bodyBytes, &customer); err != nil {
@@ -124,27 +191,23 @@ func ProcessOutgoing(delivery amqp.Delivery, client *sql.DB) error {
 		if customer.LastChatID != nil && *customer.LastChatID == "" {
 			customer.LastChatID = nil
 		}
-		err := database.UpsertCustomer(client, &customer)
-		if err != nil {
+		if err := database.UpsertCustomer(exec, &customer); err != nil {
 			return fmt.Errorf("error on upserting customer into the db: %w", err)
-		} else {
-			fmt.Print("Successfully inserted customer into db!")
-			return nil
 		}
-	} else if strings.Contains(message, "sendMessage") {
+		fmt.Print("Successfully inserted customer into db!")
+		return nil
+	case "sendMessage":
 		fmt.Print("Starting SendMessage process...")
 		var msg parser.Message
 		if err := json.Unmarshal(bodyBytes, &msg); err != nil {
 			return fmt.Errorf("failed to unmarshal SendMessage body: %w", err)
 		}
-		err := database.UpsertMessages(client, &msg)
-		if err != nil {
+		if err := database.UpsertMessages(exec, &msg); err != nil {
 			return fmt.Errorf("error on upserting message into the db: %w", err)
-		} else {
-			fmt.Print("Successfully inserted message into db!")
-			return nil
 		}
-	} else if strings.Contains(message, "upsertMessage") {
+		fmt.Print("Successfully inserted message into db!")
+		return nil
+	case "upsertMessage":
 		fmt.Print("Starting UpsertMessage process...")
 		var msgMap map[string]interface{}
 		if err := json.Unmarshal(bodyBytes, &msgMap); err != nil {
@@ -159,13 +222,87 @@ func ProcessOutgoing(delivery amqp.Delivery, client *sql.DB) error {
 		msg.ChatID = getString(msgMap, "chat_id")
 		msg.Delivered = getBool(msgMap, "delivered")
 
-		err := database.UpsertMessages(client, &msg)
-		if err != nil {
+		if err := database.UpsertMessages(exec, &msg); err != nil {
 			return fmt.Errorf("error on upserting message into the db: %w", err)
-		} else {
-			fmt.Print("Successfully inserted message into db!")
-			return nil
 		}
+		fmt.Print("Successfully inserted message into db!")
+		return nil
+	}
+	return fmt.Errorf("action %q is not supported", action)
+}
+
+// notifyStoredMessage emits message.sent for a sendMessage body that was
+// recorded in the messages table. The event is keyed by the WhatsApp message
+// ID so it isn't delivered again when the send comes back through
+// evolution.send.message; bodies without a message_id are left to that path.
+func notifyStoredMessage(client *sql.DB, registry *database.WebhookRegistry, store chatstore.Store, bodyBytes []byte) {
+	var msg struct {
+		parser.Message
+		MessageID string `json:"message_id"`
+	}
+	if err := json.Unmarshal(bodyBytes, &msg); err != nil || msg.ChatID == "" {
+		return
+	}
+	if msg.MessageID == "" {
+		fmt.Printf("[DEBUG] sendMessage for chat %s has no message_id, leaving message.sent to the send path", msg.ChatID)
+		return
+	}
+	NotifyMessageSent(client, registry, store, msg.ChatID, "", &api.EventMessage{
+		ID:   msg.MessageID,
+		Type: "text",
+		Text: msg.Text,
+		From: msg.From,
+		To:   msg.To,
+	})
+}
+
+// notifySentRequest emits message.sent when a sendrequest was a WhatsApp
+// send, recognised by a destination number in the request or a message key
+// in the Evolution response.
+func notifySentRequest(client *sql.DB, registry *database.WebhookRegistry, store chatstore.Store, req *parser.Request, resp *api.Response) {
+	var body map[string]interface{}
+	_ = json.Unmarshal(req.Body, &body)
+	var respBody map[string]interface{}
+	if resp != nil {
+		_ = json.Unmarshal([]byte(resp.Body), &respBody)
+	}
+
+	remoteJid, _ := getStringPointer(respBody, "key", "remoteJid")
+	if remoteJid == "" {
+		number := getString(body, "number")
+		if number == "" {
+			return
+		}
+		remoteJid = number
+		if !strings.Contains(remoteJid, "@") {
+			remoteJid += "@s.whatsapp.net"
+		}
+	}
+	messageID, _ := getStringPointer(respBody, "key", "id")
+	connID := getString(respBody, "instanceId")
+	if connID == "" {
+		connID = req.Instance
+	}
+
+	msg := &api.EventMessage{ID: messageID, Type: "text"}
+	msg.Text = getString(body, "text")
+	if msg.Text == "" {
+		msg.Text, _ = getStringPointer(body, "textMessage", "text")
 	}
-	return fmt.Errorf("unknown message type. Message content: %s", message)
+	if mediaType := getString(body, "mediatype"); mediaType != "" {
+		msg.Type = mediaType
+		msg.Text = getString(body, "caption")
+		msg.Media = &api.EventMedia{
+			MimeType: getString(body, "mimetype"),
+			FileName: getString(body, "fileName"),
+		}
+		if media := getString(body, "media"); strings.HasPrefix(media, "http") {
+			msg.Media.Url = media
+		}
+	}
+	if ts, ok := respBody["messageTimestamp"].(float64); ok {
+		msg.Timestamp = time.Unix(int64(ts), 0).UTC().Format(time.RFC3339)
+	}
+
+	NotifyMessageSent(client, registry, store, redis.NormalizeChatID(remoteJid), connID, msg)
 }
@@ -0,0 +1,99 @@
+package process
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"wasolgo/internal/api"
+	"wasolgo/internal/chatstore"
+	"wasolgo/internal/database"
+)
+
+// notifyWebhooks queues ev for every webhook whose subscription matches it.
+// Delivery itself happens in the delivery dispatcher; events with the same ID
+// are only queued once per webhook. It reports whether any delivery was
+// queued.
+func notifyWebhooks(db *sql.DB, registry *database.WebhookRegistry, ev *api.Event) bool {
+	webhooks := registry.All()
+	if len(webhooks) == 0 {
+		fmt.Printf("[DEBUG] No webhooks configured")
+		return false
+	}
+	fmt.Printf("[DEBUG] Found %d webhooks", len(webhooks))
+	body, err := json.Marshal(ev)
+	if err != nil {
+		fmt.Printf("[ERROR] Couldn't marshal webhook event: %v", err)
+		return false
+	}
+	var chatID string
+	if ev.Chat != nil {
+		chatID = ev.Chat.ID
+	}
+	webhookQueued := false
+	for _, wh := range webhooks {
+		if !wh.Matches(ev) {
+			fmt.Printf("[DEBUG] Webhook %d filtered out for %s", wh.ID, ev.Type)
+			continue
+		}
+		if err := database.EnqueueWebhookDelivery(db, wh.ID, ev.ID, ev.Type, chatID, body); err != nil {
+			fmt.Printf("[ERROR] %v", err)
+			continue
+		}
+		fmt.Printf("[DEBUG] Queued webhook %s for: %s", ev.Type, wh.Url)
+		webhookQueued = true
+	}
+	return webhookQueued
+}
+
+// chatEvent starts an event with the chat's current state from its header.
+func chatEvent(ctx context.Context, store chatstore.Store, eventType, chatID string) *api.Event {
+	ev := api.NewEvent(eventType)
+	ev.Chat = &api.EventChat{ID: chatID}
+	chatInfo, err := store.GetChat(ctx, chatID)
+	if err != nil {
+		return ev
+	}
+	ev.Chat.Situation, _ = chatInfo["situation"].(string)
+	ev.Chat.IsOpen, _ = chatInfo["is_active"].(bool)
+	ev.Chat.Department, _ = chatInfo["department"].(string)
+	ev.Chat.Agent, _ = chatInfo["agent_id"].(string)
+	ev.Chat.Tag, _ = chatInfo["tags"].(string)
+	ev.Chat.Tabulation, _ = chatInfo["tabulation"].(string)
+	ev.Instance, _ = chatInfo["instance_id"].(string)
+	number, _ := chatInfo["number"].(string)
+	name, _ := chatInfo["name"].(string)
+	if number != "" || name != "" {
+		ev.Customer = &api.EventCustomer{Number: number, Name: name}
+	}
+	return ev
+}
+
+// NotifyMessageSent queues message.sent events for subscribed webhooks. The
+// event ID is derived from the message ID when known so the same WhatsApp
+// message seen on several paths is delivered once.
+func NotifyMessageSent(db *sql.DB, registry *database.WebhookRegistry, store chatstore.Store, chatID, connID string, msg *api.EventMessage) {
+	if db == nil {
+		fmt.Printf("[DEBUG] Database is nil, skipping webhook logic")
+		return
+	}
+	ev := chatEvent(context.Background(), store, api.EventMessageSent, chatID)
+	if connID != "" {
+		ev.Instance = connID
+	}
+	if msg.ID != "" {
+		ev.ID = "message.sent:" + msg.ID
+	}
+	msg.Direction = "outbound"
+	if msg.From == "" {
+		msg.From = ev.Chat.Agent
+	}
+	if msg.To == "" {
+		msg.To = chatID
+	}
+	ev.Message = msg
+	if !notifyWebhooks(db, registry, ev) {
+		fmt.Printf("[DEBUG] No send_message webhooks were queued for chat %s", chatID)
+	}
+}
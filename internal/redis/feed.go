@@ -0,0 +1,215 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Feed event types.
+const (
+	FeedChatCreated     = "chat.created"
+	FeedMessageAppended = "message.appended"
+	FeedChatUpdated     = "chat.updated"
+	FeedChatReopened    = "chat.reopened"
+	FeedStatusChanged   = "chat.status_changed"
+)
+
+// FeedConfig enables the change feed. Every change to a chat is added to the
+// stream of the chat's instance, feed:<instance_id>, and optionally published
+// on the chat's channel, chat:<id>:events.
+type FeedConfig struct {
+	Enabled bool
+	// MaxLen approximately caps each stream.
+	MaxLen int64
+	PubSub bool
+	// Groups are consumer groups created on every stream, reading from its
+	// start, so consumers that join later don't miss retained events.
+	Groups []string
+}
+
+var (
+	feed        FeedConfig
+	feedStreams sync.Map
+)
+
+func SetFeed(cfg FeedConfig) {
+	feed = cfg
+}
+
+func FeedKey(instance string) string {
+	if instance == "" {
+		instance = "_"
+	}
+	return "feed:" + instance
+}
+
+func ChatChannel(chatID string) string {
+	return "chat:" + chatID + ":events"
+}
+
+type feedEvent struct {
+	Type     string      `json:"type"`
+	ChatID   string      `json:"chat_id"`
+	Instance string      `json:"instance"`
+	At       string      `json:"at"`
+	Data     interface{} `json:"data,omitempty"`
+}
+
+func newFeedEvent(eventType, chatID string, header map[string]interface{}, data interface{}) *feedEvent {
+	instance, _ := header["instance_id"].(string)
+	return &feedEvent{
+		Type:     eventType,
+		ChatID:   chatID,
+		Instance: instance,
+		At:       time.Now().UTC().Format(time.RFC3339Nano),
+		Data:     data,
+	}
+}
+
+// ensureFeedGroups creates the configured consumer groups on a stream the
+// first time this process writes to it.
+func ensureFeedGroups(ctx context.Context, rdb *redis.Client, stream string) {
+	if len(feed.Groups) == 0 {
+		return
+	}
+	if _, done := feedStreams.LoadOrStore(stream, true); done {
+		return
+	}
+	for _, group := range feed.Groups {
+		err := rdb.XGroupCreateMkStream(ctx, stream, group, "0").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			log.Printf("Failed to create consumer group %s on %s: %v", group, stream, err)
+			feedStreams.Delete(stream)
+		}
+	}
+}
+
+// queueFeed queues ev on pipe, so it is published with the change it
+// describes.
+func queueFeed(ctx context.Context, rdb *redis.Client, pipe redis.Pipeliner, ev *feedEvent) error {
+	if !feed.Enabled {
+		return nil
+	}
+	data, err := json.Marshal(ev.Data)
+	if err != nil {
+		return err
+	}
+	stream := FeedKey(ev.Instance)
+	ensureFeedGroups(ctx, rdb, stream)
+	pipe.XAdd(ctx, &redis.XAddArgs{
+		Stream: stream,
+		MaxLen: feed.MaxLen,
+		Approx: feed.MaxLen > 0,
+		Values: []interface{}{
+			"type", ev.Type,
+			"chat_id", ev.ChatID,
+			"instance", ev.Instance,
+			"at", ev.At,
+			"data", string(data),
+		},
+	})
+	if feed.PubSub {
+		message, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		pipe.Publish(ctx, ChatChannel(ev.ChatID), message)
+	}
+	return nil
+}
+
+// feedLua defines the feed writes of scripts that emit their events with the
+// change they make, as queueFeed does for pipelines. chatInstance reads the
+// instance_id of a stored header in either layout; addFeed adds an event with
+// raw JSON data to the instance's stream, capped at maxlen entries when
+// positive, publishes it on the chat's channel when pubsub is '1', and
+// returns the stream.
+const feedLua = `
+local function decodeJSON(raw)
+	local ok, value = pcall(cjson.decode, raw)
+	if ok then
+		return value
+	end
+	return raw
+end
+local function chatInstance(id)
+	local key = 'chat:' .. id
+	local instance
+	if redis.call('TYPE', key).ok == 'hash' then
+		local raw = redis.call('HGET', key, 'instance_id')
+		instance = raw and decodeJSON(raw)
+	else
+		local raw = redis.call('LINDEX', key, 0)
+		local header = raw and decodeJSON(raw)
+		instance = type(header) == 'table' and header['instance_id']
+	end
+	if type(instance) == 'string' then
+		return instance
+	end
+	return ''
+end
+local function addFeed(instance, eventType, id, at, data, maxlen, pubsub)
+	local stream = 'feed:_'
+	if instance ~= '' then
+		stream = 'feed:' .. instance
+	end
+	local fields = {'type', eventType, 'chat_id', id, 'instance', instance, 'at', at, 'data', data}
+	if maxlen > 0 then
+		redis.call('XADD', stream, 'MAXLEN', '~', maxlen, '*', unpack(fields))
+	else
+		redis.call('XADD', stream, '*', unpack(fields))
+	end
+	if pubsub == '1' then
+		redis.call('PUBLISH', 'chat:' .. id .. ':events', '{"type":' .. cjson.encode(eventType) ..
+			',"chat_id":' .. cjson.encode(id) .. ',"instance":' .. cjson.encode(instance) ..
+			',"at":' .. cjson.encode(at) .. ',"data":' .. data .. '}')
+	end
+	return stream
+end
+`
+
+// feedArgs returns the feed settings passed to scripts built on feedLua: '1'
+// when the feed is enabled, the stream cap, '1' for pub/sub and the event
+// time.
+func feedArgs() []interface{} {
+	enabled, pubsub := "", ""
+	if feed.Enabled {
+		enabled = "1"
+	}
+	if feed.PubSub {
+		pubsub = "1"
+	}
+	return []interface{}{enabled, feed.MaxLen, pubsub, time.Now().UTC().Format(time.RFC3339Nano)}
+}
+
+// messageRef returns the message.appended data of a stored message: its ID
+// and preview. Subscribers fetch the message itself by the position the
+// append adds, so payloads such as base64 documents stay out of the feed.
+func messageRef(messageJSON string, preview map[string]interface{}) (string, error) {
+	var msg map[string]interface{}
+	_ = json.Unmarshal([]byte(messageJSON), &msg)
+	id, _ := msg["id"].(string)
+	if id == "" {
+		id = stringAt(msg, "key", "id")
+	}
+	b, err := json.Marshal(map[string]interface{}{"id": id, "preview": preview})
+	return string(b), err
+}
+
+// updateEvent describes a header going from previous to current.
+func updateEvent(chatID string, previous, current map[string]interface{}, fields map[string]interface{}) *feedEvent {
+	from, to := Situation(previous), Situation(current)
+	switch {
+	case from == "finished" && to != "finished":
+		return newFeedEvent(FeedChatReopened, chatID, current, map[string]interface{}{"from": from, "to": to, "fields": fields})
+	case from != to:
+		return newFeedEvent(FeedStatusChanged, chatID, current, map[string]interface{}{"from": from, "to": to, "fields": fields})
+	}
+	return newFeedEvent(FeedChatUpdated, chatID, current, map[string]interface{}{"fields": fields})
+}
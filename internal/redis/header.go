@@ -0,0 +1,194 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Chat header layouts. The legacy layout keeps the header as a JSON string at
+// index 0 of the chat:<id> list; the hash layout stores one field per header
+// key, each value JSON-encoded, so fields can be updated independently.
+const (
+	LayoutList = "list"
+	LayoutHash = "hash"
+)
+
+// The list layout stays the default while readers outside this service still
+// expect LINDEX chat:<id> 0; select the hash layout once they have moved and
+// `wasolgo chats migrate-headers` has run.
+var headerLayout = LayoutList
+
+// SetHeaderLayout selects the layout used for new chat headers. Existing
+// headers are read in either layout, and list headers are converted to hashes
+// on update when the hash layout is selected.
+func SetHeaderLayout(layout string) error {
+	switch strings.ToLower(layout) {
+	case "", LayoutList:
+		headerLayout = LayoutList
+	case LayoutHash:
+		headerLayout = LayoutHash
+	default:
+		return fmt.Errorf("unknown chat header layout %q", layout)
+	}
+	return nil
+}
+
+func HeaderLayout() string {
+	return headerLayout
+}
+
+// readHeaderScript returns {type, value} where value is the list header or
+// the flat HGETALL reply, so either layout is read in a single round trip.
+var readHeaderScript = redis.NewScript(`
+local t = redis.call('TYPE', KEYS[1]).ok
+if t == 'list' then
+	return {t, redis.call('LINDEX', KEYS[1], 0)}
+elseif t == 'hash' then
+	return {t, redis.call('HGETALL', KEYS[1])}
+end
+return {t, false}
+`)
+
+func readHeader(ctx context.Context, rdb redis.Scripter, chatKey string) (map[string]interface{}, string, error) {
+	res, err := readHeaderScript.Run(ctx, rdb, []string{chatKey}).Slice()
+	if err != nil {
+		return nil, "", err
+	}
+	layout, _ := res[0].(string)
+	switch layout {
+	case LayoutList:
+		chatJSON, ok := res[1].(string)
+		if !ok {
+			return nil, layout, redis.Nil
+		}
+		var chatObj map[string]interface{}
+		if err := json.Unmarshal([]byte(chatJSON), &chatObj); err != nil {
+			return nil, layout, err
+		}
+		return chatObj, layout, nil
+	case LayoutHash:
+		flat, _ := res[1].([]interface{})
+		chatObj := make(map[string]interface{}, len(flat)/2)
+		for i := 0; i+1 < len(flat); i += 2 {
+			field, _ := flat[i].(string)
+			raw, _ := flat[i+1].(string)
+			chatObj[field] = decodeHeaderValue(raw)
+		}
+		return chatObj, layout, nil
+	case "none":
+		return nil, layout, redis.Nil
+	}
+	return nil, layout, fmt.Errorf("chat key %s has unexpected type %s", chatKey, layout)
+}
+
+func decodeHeaderValue(raw string) interface{} {
+	var value interface{}
+	if err := json.Unmarshal([]byte(raw), &value); err != nil {
+		// Written by something other than this package; keep it verbatim.
+		return raw
+	}
+	return value
+}
+
+func encodeHeaderFields(fields map[string]interface{}) ([]interface{}, error) {
+	args := make([]interface{}, 0, len(fields)*2)
+	for field, value := range fields {
+		b, err := json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't encode chat field %s: %w", field, err)
+		}
+		args = append(args, field, string(b))
+	}
+	return args, nil
+}
+
+// ConvertChatHeader rewrites a list header as a hash. It returns false when
+// the chat already uses the hash layout. The conversion is done in a
+// WATCH/MULTI transaction so concurrent updates aren't lost. Lists holding
+// more than the header, left by duplicate pushes of older versions, are
+// converted from the header at index 0 and the extra entries are logged
+// before they are dropped.
+func ConvertChatHeader(ctx context.Context, rdb *redis.Client, chatID string) (bool, error) {
+	chatKey := "chat:" + chatID
+	converted := false
+	err := watch(ctx, rdb, func(tx *redis.Tx) error {
+		converted = false
+		keyType, err := tx.Type(ctx, chatKey).Result()
+		if err != nil {
+			return err
+		}
+		switch keyType {
+		case LayoutHash:
+			return nil
+		case "none":
+			return redis.Nil
+		case LayoutList:
+		default:
+			return fmt.Errorf("chat key %s has unexpected type %s", chatKey, keyType)
+		}
+		entries, err := tx.LRange(ctx, chatKey, 0, -1).Result()
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			return redis.Nil
+		}
+		chatJSON := entries[0]
+		var chatObj map[string]interface{}
+		if err := json.Unmarshal([]byte(chatJSON), &chatObj); err != nil {
+			return fmt.Errorf("chat key %s has an invalid header: %w", chatKey, err)
+		}
+		if len(chatObj) == 0 {
+			return fmt.Errorf("chat key %s has an empty header", chatKey)
+		}
+		args, err := encodeHeaderFields(chatObj)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, chatKey)
+			pipe.HSet(ctx, chatKey, args...)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		converted = true
+		for i, extra := range entries[1:] {
+			log.Printf("Dropped extra entry %d of %s while converting its header: %s", i+1, chatKey, extra)
+		}
+		return nil
+	}, chatKey)
+	return converted, err
+}
+
+// queueHeader queues replacing the whole header on pipe, keeping the layout
+// the chat already has, or using the configured layout for new chats.
+func queueHeader(ctx context.Context, pipe redis.Pipeliner, chatKey, layout string, chatObj map[string]interface{}) error {
+	if layout == "" || layout == "none" {
+		layout = headerLayout
+	}
+	if layout == LayoutList {
+		chatJSON, err := json.Marshal(chatObj)
+		if err != nil {
+			return err
+		}
+		pipe.Del(ctx, chatKey)
+		pipe.RPush(ctx, chatKey, chatJSON)
+		return nil
+	}
+	args, err := encodeHeaderFields(chatObj)
+	if err != nil {
+		return err
+	}
+	pipe.Del(ctx, chatKey)
+	if len(args) > 0 {
+		pipe.HSet(ctx, chatKey, args...)
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+	"unicode/utf8"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ActivityKey is the sorted set of every chat scored by the Unix time in
+// milliseconds of its last message. Active chats are also kept in the inbox
+// of their agent and of their department, scored the same way.
+const ActivityKey = "chats:activity"
+
+func AgentInboxKey(agentID string) string {
+	return "inbox:agent:" + agentID
+}
+
+func DepartmentInboxKey(department string) string {
+	return "inbox:department:" + department
+}
+
+const previewLength = 140
+
+// MessagePreview returns the last_message header field for a stored message.
+func MessagePreview(messageJSON string, inbound bool, at time.Time) map[string]interface{} {
+	var msg map[string]interface{}
+	_ = json.Unmarshal([]byte(messageJSON), &msg)
+
+	text, _ := msg["text"].(string)
+	for _, path := range [][]string{{"conversation"}, {"extendedTextMessage", "text"}, {"caption"}} {
+		if text != "" {
+			break
+		}
+		text = stringAt(msg, path...)
+	}
+	if utf8.RuneCountInString(text) > previewLength {
+		text = string([]rune(text)[:previewLength]) + "…"
+	}
+	msgType, _ := msg["type"].(string)
+	if msgType == "" {
+		msgType = "text"
+		if _, ok := msg["documentMessage"]; ok {
+			msgType = "document"
+		}
+	}
+	direction := "outbound"
+	if inbound {
+		direction = "inbound"
+	}
+	from, _ := msg["from"].(string)
+	return map[string]interface{}{
+		"text":      text,
+		"type":      msgType,
+		"from":      from,
+		"direction": direction,
+		"at":        at.UTC().Format(time.RFC3339),
+	}
+}
+
+func stringAt(m map[string]interface{}, path ...string) string {
+	var current interface{} = m
+	for _, p := range path {
+		obj, ok := current.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		current = obj[p]
+	}
+	s, _ := current.(string)
+	return s
+}
+
+// touchChat records a new message on the chat: its activity score, the
+// last-message preview and, for customer messages, the unread counter. The
+// header is read and written under WATCH so a concurrent update or message
+// isn't overwritten by a stale copy of a list header.
+func touchChat(ctx context.Context, rdb *redis.Client, chatID string, preview map[string]interface{}, at time.Time, inbound bool) error {
+	chatKey := "chat:" + chatID
+	score := float64(at.UnixMilli())
+	fields := map[string]interface{}{
+		"last_message":     preview,
+		"last_activity_at": at.UTC().Format(time.RFC3339),
+	}
+	return watch(ctx, rdb, func(tx *redis.Tx) error {
+		header, layout, err := readHeader(ctx, tx, chatKey)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.ZAdd(ctx, ActivityKey, redis.Z{Score: score, Member: chatID})
+			queueInbox(ctx, pipe, chatID, nil, header, score)
+			if layout == LayoutList {
+				updated := make(map[string]interface{}, len(header)+len(fields)+1)
+				for k, v := range header {
+					updated[k] = v
+				}
+				for k, v := range fields {
+					updated[k] = v
+				}
+				if inbound {
+					updated["unread"] = unreadCount(header) + 1
+				}
+				chatJSON, err := json.Marshal(updated)
+				if err != nil {
+					return err
+				}
+				pipe.LSet(ctx, chatKey, 0, chatJSON)
+				return nil
+			}
+			args, err := encodeHeaderFields(fields)
+			if err != nil {
+				return err
+			}
+			pipe.HSet(ctx, chatKey, args...)
+			if inbound {
+				// The counter is a bare integer, which is also its JSON encoding.
+				pipe.HIncrBy(ctx, chatKey, "unread", 1)
+			}
+			return nil
+		})
+		return err
+	}, chatKey)
+}
+
+func unreadCount(header map[string]interface{}) int64 {
+	n, _ := header["unread"].(float64)
+	return int64(n)
+}
+
+// Situation returns the situation of a chat header, treating inactive chats
+// as finished.
+func Situation(header map[string]interface{}) string {
+	situation, _ := header["situation"].(string)
+	if isActive, ok := header["is_active"].(bool); ok && !isActive {
+		return "finished"
+	}
+	return situation
+}
+
+// inboxOf returns the inboxes a chat header belongs in.
+func inboxOf(header map[string]interface{}) (agentID, department string, active bool) {
+	if header == nil {
+		return "", "", false
+	}
+	agentID, _ = header["agent_id"].(string)
+	department, _ = header["department"].(string)
+	return agentID, department, Situation(header) != "finished"
+}
+
+// queueInbox moves the chat between inboxes for a header going from previous
+// to current. A nil previous only adds the chat to its current inboxes; a nil
+// current only removes it from the previous ones.
+func queueInbox(ctx context.Context, pipe redis.Pipeliner, chatID string, previous, current map[string]interface{}, score float64) {
+	oldAgent, oldDepartment, oldActive := inboxOf(previous)
+	newAgent, newDepartment, newActive := inboxOf(current)
+	if oldActive && oldAgent != "" && (!newActive || oldAgent != newAgent) {
+		pipe.ZRem(ctx, AgentInboxKey(oldAgent), chatID)
+	}
+	if oldActive && oldDepartment != "" && (!newActive || oldDepartment != newDepartment) {
+		pipe.ZRem(ctx, DepartmentInboxKey(oldDepartment), chatID)
+	}
+	if !newActive {
+		return
+	}
+	if newAgent != "" {
+		pipe.ZAdd(ctx, AgentInboxKey(newAgent), redis.Z{Score: score, Member: chatID})
+	}
+	if newDepartment != "" {
+		pipe.ZAdd(ctx, DepartmentInboxKey(newDepartment), redis.Z{Score: score, Member: chatID})
+	}
+}
+
+// inboxMoved reports whether a header going from previous to current moves
+// the chat between inboxes.
+func inboxMoved(previous, current map[string]interface{}) bool {
+	oldAgent, oldDepartment, oldActive := inboxOf(previous)
+	newAgent, newDepartment, newActive := inboxOf(current)
+	return oldAgent != newAgent || oldDepartment != newDepartment || oldActive != newActive
+}
+
+// activityScore returns the activity score of the chat, so it keeps its place
+// when moved between inboxes; chats not indexed yet score now.
+func activityScore(ctx context.Context, c redis.Cmdable, chatID string) (float64, error) {
+	score, err := c.ZScore(ctx, ActivityKey, chatID).Result()
+	if errors.Is(err, redis.Nil) {
+		return float64(time.Now().UnixMilli()), nil
+	}
+	return score, err
+}
+
+// IndexChat adds a chat that predates the activity indexes to them, scored by
+// its last activity or, failing that, its last message. Chats already indexed
+// keep their score, so it can run while messages arrive. It returns false
+// when the chat doesn't exist.
+func IndexChat(ctx context.Context, rdb *redis.Client, chatID string) (bool, error) {
+	chatKey := "chat:" + chatID
+	header, _, err := readHeader(ctx, rdb, chatKey)
+	if errors.Is(err, redis.Nil) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var at time.Time
+	if value, _ := header["last_activity_at"].(string); value != "" {
+		at, _ = time.Parse(time.RFC3339, value)
+	}
+	if at.IsZero() {
+		last, err := rdb.LIndex(ctx, chatKey+":messages", -1).Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return false, err
+		}
+		at, _ = MessageTime(last)
+	}
+	var score float64
+	if !at.IsZero() {
+		score = float64(at.UnixMilli())
+	}
+	agentID, department, active := inboxOf(header)
+	_, err = rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		member := redis.Z{Score: score, Member: chatID}
+		pipe.ZAddNX(ctx, ActivityKey, member)
+		if !active {
+			return nil
+		}
+		if agentID != "" {
+			pipe.ZAddNX(ctx, AgentInboxKey(agentID), member)
+		}
+		if department != "" {
+			pipe.ZAddNX(ctx, DepartmentInboxKey(department), member)
+		}
+		return nil
+	})
+	return err == nil, err
+}
+
+// MarkRead resets the unread counter of the chat.
+func MarkRead(ctx context.Context, rdb *redis.Client, chatID string) error {
+	_, err := UpdateChat(ctx, rdb, chatID, map[string]interface{}{"unread": 0})
+	return err
+}
+
+// ListChats returns the chats of the sorted set key, most recent activity
+// first, between start and stop inclusive.
+func ListChats(ctx context.Context, rdb *redis.Client, key string, start, stop int64) ([]string, error) {
+	return rdb.ZRevRange(ctx, key, start, stop).Result()
+}
@@ -0,0 +1,240 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ChatMerge describes the merge of duplicate chats into Target.
+type ChatMerge struct {
+	Target string
+	// Sources are the duplicates folded into Target; Target itself is not
+	// included.
+	Sources []string
+	// Messages is the number of messages each chat held before the merge,
+	// keyed by chat ID.
+	Messages map[string]int
+	// Archived is the number of messages of each chat already archived to
+	// Postgres, keyed by chat ID. The merged chat's archived history is the
+	// target's followed by each source's, in order.
+	Archived map[string]int64
+	// Merged is the number of messages of the merged chat, after dropping
+	// messages present in more than one duplicate.
+	Merged int
+	// HeaderFrom is the chat whose header is kept: the one with the most
+	// recent message.
+	HeaderFrom string
+}
+
+// MergeChats folds the chats in ids into target. Message lists are merged by
+// timestamp, the header of the chat with the most recent message is kept, and
+// the merged-away IDs become aliases of target. Archived counts are added up
+// into the target's; the archived rows themselves are moved by
+// database.MergeChatIDs, which must run first, and the archiver must be kept
+// off the chats meanwhile. The merged header keeps the
+// layout of target, or of the chat it came from when target has none. With
+// apply false it only reports what would be merged. The merge runs in a
+// WATCH/MULTI transaction and is retried when one of the chats changes
+// meanwhile; once applied, running it again finds nothing left to merge.
+func MergeChats(ctx context.Context, rdb *redis.Client, target string, ids []string, apply bool) (*ChatMerge, error) {
+	merge := &ChatMerge{Target: target, Messages: map[string]int{}, Archived: map[string]int64{}}
+	members := []string{target}
+	for _, id := range ids {
+		if id != target {
+			merge.Sources = append(merge.Sources, id)
+			members = append(members, id)
+		}
+	}
+	keys := make([]string, 0, len(members)*3)
+	for _, id := range members {
+		keys = append(keys, "chat:"+id, "chat:"+id+":messages", archivedKey(id))
+	}
+
+	err := watch(ctx, rdb, func(tx *redis.Tx) error {
+		var lists [][]string
+		var header map[string]interface{}
+		var latest time.Time
+		headers := map[string]map[string]interface{}{}
+		layouts := map[string]string{}
+		merge.HeaderFrom = ""
+		for _, id := range members {
+			messages, err := tx.LRange(ctx, "chat:"+id+":messages", 0, -1).Result()
+			if err != nil {
+				return err
+			}
+			merge.Messages[id] = len(messages)
+			lists = append(lists, messages)
+			archived, err := tx.Get(ctx, archivedKey(id)).Int64()
+			if err != nil && !errors.Is(err, redis.Nil) {
+				return err
+			}
+			merge.Archived[id] = archived
+
+			chatObj, layout, err := readHeader(ctx, tx, "chat:"+id)
+			if errors.Is(err, redis.Nil) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			headers[id] = chatObj
+			layouts[id] = layout
+			last := lastMessageTime(messages)
+			if header == nil || last.After(latest) {
+				header, latest, merge.HeaderFrom = chatObj, last, id
+			}
+		}
+		merged := mergeMessages(lists)
+		merge.Merged = len(merged)
+		if !apply {
+			return nil
+		}
+		if header == nil {
+			header = map[string]interface{}{}
+		}
+		if headerID, _ := header["id"].(string); headerID == "" || headerID == merge.HeaderFrom {
+			header["id"] = target
+		}
+		score := float64(time.Now().UnixMilli())
+		if !latest.IsZero() {
+			score = float64(latest.UnixMilli())
+		}
+		var archived int64
+		for _, n := range merge.Archived {
+			archived += n
+		}
+		layout, ok := layouts[target]
+		if !ok {
+			layout = layouts[merge.HeaderFrom]
+		}
+
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, id := range merge.Sources {
+				pipe.Del(ctx, "chat:"+id, "chat:"+id+":messages", archivedKey(id))
+				pipe.SRem(ctx, "chats", id)
+				queueAlias(ctx, pipe, id, target)
+				pipe.ZRem(ctx, ActivityKey, id)
+				queueInbox(ctx, pipe, id, headers[id], nil, 0)
+			}
+			if err := queueHeader(ctx, pipe, "chat:"+target, layout, header); err != nil {
+				return err
+			}
+			pipe.Del(ctx, "chat:"+target+":messages")
+			if len(merged) > 0 {
+				values := make([]interface{}, len(merged))
+				for i, m := range merged {
+					values[i] = m
+				}
+				pipe.RPush(ctx, "chat:"+target+":messages", values...)
+			}
+			if archived > 0 {
+				pipe.Set(ctx, archivedKey(target), archived, 0)
+			}
+			pipe.SAdd(ctx, "chats", target)
+			queueAlias(ctx, pipe, target, target)
+			pipe.ZAdd(ctx, ActivityKey, redis.Z{Score: score, Member: target})
+			queueInbox(ctx, pipe, target, headers[target], header, score)
+			return nil
+		})
+		return err
+	}, keys...)
+	if err != nil {
+		return nil, err
+	}
+	return merge, nil
+}
+
+// mergeMessages merges the message lists by timestamp. Messages without a
+// readable timestamp keep their place after the message before them, and
+// messages present in several lists are kept once.
+func mergeMessages(lists [][]string) []string {
+	type entry struct {
+		at  time.Time
+		raw string
+	}
+	var entries []entry
+	for _, messages := range lists {
+		var at time.Time
+		for _, raw := range messages {
+			if t, ok := MessageTime(raw); ok {
+				at = t
+			}
+			entries = append(entries, entry{at: at, raw: raw})
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].at.Before(entries[j].at)
+	})
+
+	seen := make(map[string]bool, len(entries))
+	merged := make([]string, 0, len(entries))
+	for _, e := range entries {
+		key := e.raw
+		var msg map[string]interface{}
+		if err := json.Unmarshal([]byte(e.raw), &msg); err == nil {
+			if id, _ := msg["id"].(string); id != "" && id != "msg_" {
+				key = id
+			}
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		merged = append(merged, e.raw)
+	}
+	return merged
+}
+
+func lastMessageTime(messages []string) time.Time {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if t, ok := MessageTime(messages[i]); ok {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+var messageTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+}
+
+// MessageTime reads the timestamp of a stored message, written as a date
+// string by the incoming path or as Unix seconds by Evolution.
+func MessageTime(raw string) (time.Time, bool) {
+	var msg map[string]interface{}
+	if err := json.Unmarshal([]byte(raw), &msg); err != nil {
+		return time.Time{}, false
+	}
+	for _, key := range []string{"timestamp", "messageTimestamp", "date_time"} {
+		switch v := msg[key].(type) {
+		case float64:
+			return unixTime(int64(v)), true
+		case string:
+			if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+				return unixTime(n), true
+			}
+			for _, layout := range messageTimeLayouts {
+				if t, err := time.Parse(layout, v); err == nil {
+					return t, true
+				}
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+// unixTime accepts seconds or milliseconds.
+func unixTime(n int64) time.Time {
+	if n > 1e12 {
+		return time.UnixMilli(n)
+	}
+	return time.Unix(n, 0)
+}
@@ -3,9 +3,13 @@ package redis
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"strings"
+	"time"
+
+	"wasolgo/internal/phone"
 
 	"github.com/redis/go-redis/v9"
 )
@@ -19,184 +23,380 @@ func ConnectRedis(redisURL string) (*redis.Client, error) {
 	return client, nil
 }
 
+// NormalizeChatID returns the canonical chat ID for a WhatsApp JID.
 func NormalizeChatID(jid string) string {
-	parts := strings.SplitN(jid, "@", 2)
-	if len(parts) == 2 {
-		number, domain := parts[0], parts[1]
-		if strings.HasPrefix(number, "55") && len(number) > 4 {
-			countryCode := number[:2]
-			areaCode := number[2:4]
-			numPart := number[4:]
-			if len(numPart) == 8 {
-				numPart = "9" + numPart
-			}
-			normalizedNumber := countryCode + areaCode + numPart
-			return fmt.Sprintf("%s@%s", normalizedNumber, domain)
-		}
-	}
-	return jid
+	return phone.NormalizeJID(jid)
 }
 
+// PossibleChatIDs returns every ID the chat for jid may be stored under, in
+// lookup order.
 func PossibleChatIDs(jid string) []string {
-	parts := strings.SplitN(jid, "@", 2)
-	if len(parts) != 2 {
-		return []string{jid}
-	}
-	number, domain := parts[0], parts[1]
-	if strings.HasPrefix(number, "55") && len(number) > 4 {
-		countryCode := number[:2]
-		areaCode := number[2:4]
-		numPart := number[4:]
-		ids := []string{}
-		ids = append(ids, fmt.Sprintf("%s@%s", number, domain))
-		if len(numPart) == 8 {
-			normalized := countryCode + areaCode + "9" + numPart
-			ids = append(ids, fmt.Sprintf("%s@%s", normalized, domain))
-		} else if len(numPart) == 9 && strings.HasPrefix(numPart, "9") {
-			normalized := countryCode + areaCode + numPart
-			if normalized != number {
-				ids = append(ids, fmt.Sprintf("%s@%s", normalized, domain))
-			}
-		}
-		return ids
-	}
-	return []string{jid}
+	return phone.JIDVariants(jid)
 }
 
-func FindExistingChatID(ctx context.Context, rdb *redis.Client, chatID string) (string, error) {
+// resolveChatLua defines the chat resolution shared by the scripts below.
+// resolve returns the chat the candidates ARGV[first..first+n-1] belong to,
+// following chat_alias:<variant> first and falling back to probing chat:<id>
+// for chats created before the alias index. link points every candidate
+// without a live alias at id, so later lookups take a single GET. A candidate
+// that has a chat of its own is a duplicate and isn't aliased, so it stays
+// reachable by its ID; such pairs are left to `wasolgo chats merge`.
+const resolveChatLua = `
+local function resolve(first, n)
+	for i = first, first + n - 1 do
+		local id = redis.call('GET', 'chat_alias:' .. ARGV[i])
+		if id and redis.call('EXISTS', 'chat:' .. id) == 1 then
+			return id
+		end
+	end
+	for i = first, first + n - 1 do
+		if redis.call('EXISTS', 'chat:' .. ARGV[i]) == 1 then
+			return ARGV[i]
+		end
+	end
+	return false
+end
+local function setAlias(variant, id)
+	if variant ~= id and redis.call('EXISTS', 'chat:' .. variant) == 1 then
+		return
+	end
+	local current = redis.call('GET', 'chat_alias:' .. variant)
+	if current ~= id and (not current or redis.call('EXISTS', 'chat:' .. current) == 0) then
+		redis.call('SET', 'chat_alias:' .. variant, id)
+	end
+end
+local function link(first, n, id)
+	setAlias(id, id)
+	for i = first, first + n - 1 do
+		setAlias(ARGV[i], id)
+	end
+end
+`
+
+// findChatScript resolves the chat for the candidate IDs and records their
+// aliases.
+//
+// ARGV: candidate count, candidate ids...
+// Returns: the chat ID, or nil when no candidate exists
+var findChatScript = redis.NewScript(resolveChatLua + `
+local n = tonumber(ARGV[1])
+local id = resolve(2, n)
+if id then
+	link(2, n, id)
+end
+return id
+`)
+
+// FindChat returns the ID of the existing chat among the known variants of
+// chatID, and false when none of them exists.
+func FindChat(ctx context.Context, rdb *redis.Client, chatID string) (string, bool, error) {
 	possibleIDs := PossibleChatIDs(chatID)
-	log.Printf("[FindExistingChatID] Checking possible chat IDs for %s: %v", chatID, possibleIDs)
+	args := make([]interface{}, 0, len(possibleIDs)+1)
+	args = append(args, len(possibleIDs))
 	for _, id := range possibleIDs {
-		key := "chat:" + id
-		exists, err := rdb.Exists(ctx, key).Result()
-		if err != nil {
-			log.Printf("[FindExistingChatID] Error checking key %s: %v", key, err)
-			return "", err
-		}
-		log.Printf("[FindExistingChatID] Key %s exists: %d", key, exists)
-		if exists > 0 {
-			log.Printf("[FindExistingChatID] Found existing chat key: %s", key)
+		args = append(args, id)
+	}
+	id, err := findChatScript.Run(ctx, rdb, nil, args...).Text()
+	if err == redis.Nil {
+		return "", false, nil
+	}
+	if err != nil {
+		log.Printf("[FindChat] Error resolving chat %s: %v", chatID, err)
+		return "", false, err
+	}
+	return id, true, nil
+}
+
+// aliasKey is the key pointing variant at the chat it belongs to, maintained
+// by the scripts above and by merges.
+func aliasKey(variant string) string {
+	return "chat_alias:" + variant
+}
+
+// queueAlias queues pointing the alias of variant at chatID on pipe,
+// replacing any existing alias.
+func queueAlias(ctx context.Context, pipe redis.Pipeliner, variant, chatID string) {
+	pipe.Set(ctx, aliasKey(variant), chatID, 0)
+}
+
+// FindExistingChatID is FindChat falling back to the ID a dropped chat was
+// stored under, and to the normalized ID when the chat doesn't exist yet.
+func FindExistingChatID(ctx context.Context, rdb *redis.Client, chatID string) (string, error) {
+	id, found, err := FindChat(ctx, rdb, chatID)
+	if err != nil {
+		return "", err
+	}
+	if found {
+		return id, nil
+	}
+	// The aliases of a dropped chat outlive it, so its archived history is
+	// still found under the ID it was stored with.
+	for _, variant := range PossibleChatIDs(chatID) {
+		id, err := rdb.Get(ctx, aliasKey(variant)).Result()
+		if err == nil {
 			return id, nil
 		}
+		if !errors.Is(err, redis.Nil) {
+			return "", err
+		}
 	}
 	normalized := NormalizeChatID(chatID)
 	log.Printf("[FindExistingChatID] No existing chat found, using normalized: %s", normalized)
 	return normalized, nil
 }
 
-func EnsureChatExists(ctx context.Context, rdb *redis.Client, chatID, remoteJid string, chatMetadata *string, messageData *[]byte) error {
-	existingChatID, err := FindExistingChatID(ctx, rdb, chatID)
-	if err != nil {
-		return err
+// NewChatHeader returns the header of a new chat opened by a customer
+// message.
+func NewChatHeader(chatID, remoteJid, instanceID string) map[string]interface{} {
+	number := strings.SplitN(remoteJid, "@", 2)[0]
+	return map[string]interface{}{
+		"id":          chatID,
+		"situation":   "enqueued",
+		"is_active":   true,
+		"agent_id":    nil,
+		"tabulation":  nil,
+		"instance_id": instanceID,
+		"number":      number,
 	}
-	chatKey := "chat:" + existingChatID
-	exists, err := rdb.Exists(ctx, chatKey).Result()
-	if err != nil {
-		return err
+}
+
+// appendMessageScript resolves the chat among the candidate IDs, creates it
+// with the given header when none exists, records the aliases of every
+// candidate and appends the message, all in one round trip so concurrent
+// workers can't create duplicate headers. An empty message only ensures the
+// chat exists. The chat.created and message.appended feed events are added in
+// the same script, so they can't be lost once the change is made; the
+// message event carries the reference with the message's position in the
+// chat's history added.
+//
+// ARGV: normalized id, message JSON, header layout, list header JSON, feed
+// args (see feedArgs), message reference JSON, candidate count, candidate
+// ids..., hash header field/value pairs...
+// Returns: {resolved id, 1 if the chat was created, feed stream or empty}
+var appendMessageScript = redis.NewScript(resolveChatLua + feedLua + `
+local n = tonumber(ARGV[10])
+local id = resolve(11, n)
+local created = 0
+if not id then
+	id = ARGV[1]
+	if ARGV[3] == 'hash' then
+		redis.call('HSET', 'chat:' .. id, unpack(ARGV, 11 + n))
+	else
+		redis.call('RPUSH', 'chat:' .. id, ARGV[4])
+	end
+	created = 1
+end
+link(11, n, id)
+redis.call('SADD', 'chats', id)
+local position
+if ARGV[2] ~= '' then
+	position = redis.call('RPUSH', 'chat:' .. id .. ':messages', ARGV[2]) - 1
+	position = position + (tonumber(redis.call('GET', 'chat:' .. id .. ':archived')) or 0)
+end
+local stream = ''
+if ARGV[5] == '1' then
+	local instance = chatInstance(id)
+	local maxlen = tonumber(ARGV[6])
+	if created == 1 then
+		stream = addFeed(instance, 'chat.created', id, ARGV[8], ARGV[4], maxlen, ARGV[7])
+	end
+	if position then
+		local ref = cjson.decode(ARGV[9])
+		ref['position'] = position
+		stream = addFeed(instance, 'message.appended', id, ARGV[8], cjson.encode(ref), maxlen, ARGV[7])
+	end
+end
+return {id, created, stream}
+`)
+
+// AppendMessage atomically resolves or creates the chat for chatID and
+// appends messageJSON to it, then updates the activity indexes and the
+// last-message preview, counting inbound messages as unread. header is only
+// written when the chat is created; when nil, a header holding just the ID is
+// used. It returns the chat ID used and whether the chat was created.
+func AppendMessage(ctx context.Context, rdb *redis.Client, chatID, messageJSON string, inbound bool, header map[string]interface{}) (string, bool, error) {
+	normalized := NormalizeChatID(chatID)
+	if len(header) == 0 {
+		header = map[string]interface{}{"id": normalized}
 	}
-	foundInSet, err := rdb.SIsMember(ctx, "chats", existingChatID).Result()
+	headerJSON, err := json.Marshal(header)
 	if err != nil {
-		return err
-	}
-	if exists == 0 {
-		var chatData string
-		if chatMetadata != nil {
-			chatData = *chatMetadata
-		} else {
-			number := strings.SplitN(remoteJid, "@", 2)[0]
-			instanceID := ""
-			if messageData != nil {
-				var value map[string]interface{}
-				if err := json.Unmarshal(*messageData, &value); err == nil {
-					if apikey, ok := value["apikey"].(string); ok {
-						instanceID = apikey
-					}
-				}
-			}
-			meta := map[string]interface{}{
-				"id":          existingChatID,
-				"situation":   "enqueued",
-				"is_active":   true,
-				"agent_id":    nil,
-				"tabulation":  nil,
-				"instance_id": instanceID,
-				"number":      number,
-			}
-			b, _ := json.Marshal(meta)
-			chatData = string(b)
+		return "", false, fmt.Errorf("invalid chat header: %w", err)
+	}
+	now := time.Now()
+	var preview map[string]interface{}
+	ref := "{}"
+	if messageJSON != "" {
+		preview = MessagePreview(messageJSON, inbound, now)
+		if ref, err = messageRef(messageJSON, preview); err != nil {
+			return "", false, err
 		}
-		if _, err := rdb.RPush(ctx, chatKey, chatData).Result(); err != nil {
-			return err
+	}
+	candidates := PossibleChatIDs(chatID)
+	args := []interface{}{normalized, messageJSON, headerLayout, string(headerJSON)}
+	args = append(args, feedArgs()...)
+	args = append(args, ref, len(candidates))
+	for _, id := range candidates {
+		args = append(args, id)
+	}
+	if headerLayout == LayoutHash {
+		fields, err := encodeHeaderFields(header)
+		if err != nil {
+			return "", false, err
 		}
-		log.Printf("Created new chat entry in Redis (as list): %s", chatKey)
-		if !foundInSet {
-			if _, err := rdb.SAdd(ctx, "chats", existingChatID).Result(); err != nil {
-				return err
-			}
-			log.Printf("Added chat_id %s to 'chats' set", existingChatID)
+		args = append(args, fields...)
+	}
+	res, err := appendMessageScript.Run(ctx, rdb, nil, args...).Slice()
+	if err != nil {
+		return "", false, err
+	}
+	if len(res) != 3 {
+		return "", false, fmt.Errorf("unexpected append script result: %v", res)
+	}
+	id, _ := res[0].(string)
+	created, _ := res[1].(int64)
+	if created == 1 {
+		log.Printf("Created new chat entry in Redis (as %s): chat:%s", headerLayout, id)
+	}
+	if stream, _ := res[2].(string); stream != "" {
+		// The groups read the stream from its start, so creating them after
+		// the first event doesn't skip it.
+		ensureFeedGroups(ctx, rdb, stream)
+	}
+	if messageJSON != "" {
+		// The message is stored; a failure here only leaves the indexes
+		// behind until the next message, so it isn't worth a redelivery.
+		if err := touchChat(ctx, rdb, id, preview, now, inbound); err != nil {
+			log.Printf("Failed to update activity of chat:%s: %v", id, err)
 		}
-	} else {
-		log.Printf("Chat entry already exists in Redis: %s", chatKey)
 	}
-	return nil
+	return id, created == 1, nil
 }
 
-func InsertMessageToChat(
-	ctx context.Context,
-	rdb *redis.Client,
-	chatID string,
-	messageJSON string,
-	remoteJid string,
-	chatMetadata *string,
-	messageData *[]byte,
-) error {
+// EnsureChat resolves the chat for chatID, creating it with header when it
+// doesn't exist.
+func EnsureChat(ctx context.Context, rdb *redis.Client, chatID string, header map[string]interface{}) (string, bool, error) {
+	return AppendMessage(ctx, rdb, chatID, "", false, header)
+}
+
+// ListMessages returns the messages of the chat between start and stop,
+// inclusive, with LRANGE semantics.
+func ListMessages(ctx context.Context, rdb *redis.Client, chatID string, start, stop int64) ([]string, error) {
 	existingChatID, err := FindExistingChatID(ctx, rdb, chatID)
 	if err != nil {
-		log.Printf("Failed to resolve existing chat ID: %v", err)
-		return err
-	}
-	log.Printf("Inserting message into chat:%s for remote_jid:%s", existingChatID, remoteJid)
-	if err := EnsureChatExists(ctx, rdb, existingChatID, remoteJid, chatMetadata, messageData); err != nil {
-		log.Printf("Failed to ensure chat exists: %v", err)
-		return err
-	}
-	key := fmt.Sprintf("chat:%s:messages", existingChatID)
-	log.Printf("Pushing message to Redis list: %s", key)
-	if _, err := rdb.RPush(ctx, key, messageJSON).Result(); err != nil {
-		return err
+		return nil, err
 	}
-	log.Printf("Successfully inserted message into Redis for chat:%s", existingChatID)
-	return nil
+	return rdb.LRange(ctx, "chat:"+existingChatID+":messages", start, stop).Result()
 }
 
-func UpdateChatToOpen(ctx context.Context, rdb *redis.Client, chatID string) error {
+// UpdateChat merges fields into the chat header and returns the header as it
+// was before the update.
+func UpdateChat(ctx context.Context, rdb *redis.Client, chatID string, fields map[string]interface{}) (map[string]interface{}, error) {
+	previous, _, err := ModifyChat(ctx, rdb, chatID, func(map[string]interface{}) (map[string]interface{}, error) {
+		return fields, nil
+	})
+	return previous, err
+}
+
+// ModifyChat merges the fields returned by modify into the chat header, with
+// modify seeing the header as it is when the update is applied. The header is
+// read and written in a WATCH/MULTI transaction, so modify may be called again
+// when the chat changes meanwhile; it must not change the header it is given.
+// A nil result leaves the chat as it is, and an error from modify is returned
+// without updating it. ModifyChat returns the header as it was before and the
+// fields applied. Hash headers are updated field by field; list headers are
+// converted when the hash layout is selected, and otherwise rewritten whole.
+// The chat is moved between inboxes when its agent, department or situation
+// changes.
+func ModifyChat(ctx context.Context, rdb *redis.Client, chatID string, modify func(header map[string]interface{}) (map[string]interface{}, error)) (map[string]interface{}, map[string]interface{}, error) {
 	existingChatID, err := FindExistingChatID(ctx, rdb, chatID)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	chatKey := "chat:" + existingChatID
-	chatJSON, err := rdb.LIndex(ctx, chatKey, 0).Result()
-	if err != nil {
-		return err
-	}
-	var chatObj map[string]interface{}
-	if err := json.Unmarshal([]byte(chatJSON), &chatObj); err != nil {
-		return err
-	}
-	chatObj["situation"] = "enqueued"
-	chatObj["is_active"] = true
-	chatObj["tabulation"] = nil
-	chatObj["tags"] = nil
-	chatObj["department"] = "aguardando_colaborador"
-	chatObj["agent_id"] = nil
-	updatedJSON, err := json.Marshal(chatObj)
+	return modifyHeader(ctx, rdb, existingChatID, modify)
+}
+
+// modifyHeader is ModifyChat for a resolved chat ID. The inbox moves and the
+// feed event are queued in the same MULTI as the header write, so they can't
+// be lost once the change is made.
+func modifyHeader(ctx context.Context, rdb *redis.Client, chatID string, modify func(map[string]interface{}) (map[string]interface{}, error)) (map[string]interface{}, map[string]interface{}, error) {
+	chatKey := "chat:" + chatID
+	var previous, fields map[string]interface{}
+	err := watch(ctx, rdb, func(tx *redis.Tx) error {
+		var layout string
+		var err error
+		previous, layout, err = readHeader(ctx, tx, chatKey)
+		if err != nil {
+			return err
+		}
+		fields, err = modify(previous)
+		if err != nil || len(fields) == 0 {
+			return err
+		}
+		// Round-trip the fields so pointers and other types read back as
+		// they are stored.
+		current := make(map[string]interface{}, len(previous)+len(fields))
+		for k, v := range previous {
+			current[k] = v
+		}
+		b, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(b, &current); err != nil {
+			return err
+		}
+		moved := inboxMoved(previous, current)
+		var score float64
+		if moved {
+			if score, err = activityScore(ctx, tx, chatID); err != nil {
+				return err
+			}
+		}
+		var extras []string
+		if layout != LayoutHash && headerLayout == LayoutHash {
+			if extras, err = tx.LRange(ctx, chatKey, 1, -1).Result(); err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			switch {
+			case layout == LayoutHash:
+				args, err := encodeHeaderFields(fields)
+				if err != nil {
+					return err
+				}
+				pipe.HSet(ctx, chatKey, args...)
+			case headerLayout == LayoutHash:
+				// Converted on the way, as ConvertChatHeader does.
+				if err := queueHeader(ctx, pipe, chatKey, LayoutHash, current); err != nil {
+					return err
+				}
+			default:
+				updatedJSON, err := json.Marshal(current)
+				if err != nil {
+					return err
+				}
+				pipe.LSet(ctx, chatKey, 0, updatedJSON)
+			}
+			if moved {
+				queueInbox(ctx, pipe, chatID, previous, current, score)
+			}
+			return queueFeed(ctx, rdb, pipe, updateEvent(chatID, previous, current, fields))
+		})
+		if err != nil {
+			return err
+		}
+		for i, extra := range extras {
+			log.Printf("Dropped extra entry %d of %s while converting its header: %s", i+1, chatKey, extra)
+		}
+		return nil
+	}, chatKey)
 	if err != nil {
-		return err
-	}
-	if err := rdb.LSet(ctx, chatKey, 0, updatedJSON).Err(); err != nil {
-		return err
+		return nil, nil, err
 	}
-	return nil
+	return previous, fields, nil
 }
 
 func GetChat(ctx context.Context, rdb *redis.Client, chatID string) (map[string]interface{}, error) {
@@ -204,14 +404,9 @@ func GetChat(ctx context.Context, rdb *redis.Client, chatID string) (map[string]
 	if err != nil {
 		return nil, err
 	}
-	chatKey := "chat:" + existingChatID
-	chatJSON, err := rdb.LIndex(ctx, chatKey, 0).Result()
+	chatObj, _, err := readHeader(ctx, rdb, "chat:"+existingChatID)
 	if err != nil {
 		return nil, err
 	}
-	var chatObj map[string]interface{}
-	if err := json.Unmarshal([]byte(chatJSON), &chatObj); err != nil {
-		return nil, err
-	}
 	return chatObj, nil
 }
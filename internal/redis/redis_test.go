@@ -0,0 +1,139 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// TestFindChatKeepsDuplicates resolves a number stored under both of its
+// variants: the variant with a chat of its own must not be aliased at the
+// other one.
+func TestFindChatKeepsDuplicates(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	const (
+		legacy = "551187654321@s.whatsapp.net"
+		target = "5511987654321@s.whatsapp.net"
+	)
+	mr.Lpush("chat:"+legacy, `{"id":"`+legacy+`"}`)
+	mr.Lpush("chat:"+target, `{"id":"`+target+`"}`)
+
+	if _, found, err := FindChat(ctx, rdb, target); err != nil || !found {
+		t.Fatalf("FindChat(%s) = %t, %v", target, found, err)
+	}
+	if alias, err := mr.Get(aliasKey(legacy)); err == nil && alias != legacy {
+		t.Errorf("alias of %s = %s, want none or itself", legacy, alias)
+	}
+	if alias, err := mr.Get(aliasKey(target)); err != nil || alias != target {
+		t.Errorf("alias of %s = %q, %v, want itself", target, alias, err)
+	}
+}
+
+// TestMergeChatsArchived merges duplicates that both have archived messages:
+// the merged chat's archived count covers both histories.
+func TestMergeChatsArchived(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	const (
+		legacy = "551187654321@s.whatsapp.net"
+		target = "5511987654321@s.whatsapp.net"
+	)
+	for id, archived := range map[string]string{legacy: "3", target: "5"} {
+		mr.Lpush("chat:"+id, `{"id":"`+id+`"}`)
+		mr.Push("chat:"+id+":messages", `{"id":"msg_`+id+`","timestamp":"2026-01-02T15:04:05Z"}`)
+		mr.Set(archivedKey(id), archived)
+		mr.SetAdd("chats", id)
+	}
+
+	merge, err := MergeChats(ctx, rdb, target, []string{target, legacy}, true)
+	if err != nil {
+		t.Fatalf("MergeChats: %v", err)
+	}
+	if merge.Archived[legacy] != 3 || merge.Archived[target] != 5 {
+		t.Errorf("Archived = %v, want %s:3 %s:5", merge.Archived, legacy, target)
+	}
+	if got, _ := mr.Get(archivedKey(target)); got != "8" {
+		t.Errorf("target archived = %q, want 8", got)
+	}
+	if mr.Exists(archivedKey(legacy)) || mr.Exists("chat:"+legacy) {
+		t.Error("legacy chat keys were kept")
+	}
+	if got, _ := mr.List("chat:" + target + ":messages"); len(got) != 2 {
+		t.Errorf("target messages = %v, want both", got)
+	}
+	if alias, _ := mr.Get(aliasKey(legacy)); alias != target {
+		t.Errorf("alias of %s = %q, want %s", legacy, alias, target)
+	}
+}
+
+// TestModifyChatFeed checks that a header update moves the chat between
+// inboxes and adds its feed event in the same transaction.
+func TestModifyChatFeed(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	SetFeed(FeedConfig{Enabled: true, MaxLen: 100})
+	defer SetFeed(FeedConfig{})
+
+	const chatID = "5511987654321@s.whatsapp.net"
+	mr.Lpush("chat:"+chatID, `{"id":"`+chatID+`","instance_id":"inst","situation":"enqueued","is_active":true,"department":"vendas"}`)
+	mr.ZAdd(ActivityKey, 42, chatID)
+	mr.ZAdd(DepartmentInboxKey("vendas"), 42, chatID)
+
+	if _, err := UpdateChat(ctx, rdb, chatID, map[string]interface{}{"situation": "assigned", "agent_id": "agent-1"}); err != nil {
+		t.Fatalf("UpdateChat: %v", err)
+	}
+	if score, err := mr.ZScore(AgentInboxKey("agent-1"), chatID); err != nil || score != 42 {
+		t.Errorf("agent inbox score = %v, %v, want 42", score, err)
+	}
+	events, err := rdb.XRange(ctx, FeedKey("inst"), "-", "+").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Values["type"] != FeedStatusChanged {
+		t.Errorf("feed events = %v, want one %s", events, FeedStatusChanged)
+	}
+}
+
+// TestAppendMessageFeed checks the events the append script adds: the new
+// chat, and a reference to the message rather than its payload.
+func TestAppendMessageFeed(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	SetFeed(FeedConfig{Enabled: true, MaxLen: 100})
+	defer SetFeed(FeedConfig{})
+
+	const chatID = "5511987654321@s.whatsapp.net"
+	mr.Set(archivedKey(chatID), "3")
+	message := `{"id":"msg_ABC","text":"oi","body":"BASE64PAYLOAD"}`
+	if _, _, err := AppendMessage(ctx, rdb, chatID, message, true, NewChatHeader(chatID, chatID, "inst")); err != nil {
+		t.Fatalf("AppendMessage: %v", err)
+	}
+	events, err := rdb.XRange(ctx, FeedKey("inst"), "-", "+").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Values["type"] != FeedChatCreated || events[1].Values["type"] != FeedMessageAppended {
+		t.Fatalf("feed events = %v, want %s and %s", events, FeedChatCreated, FeedMessageAppended)
+	}
+	var ref map[string]interface{}
+	if err := json.Unmarshal([]byte(events[1].Values["data"].(string)), &ref); err != nil {
+		t.Fatal(err)
+	}
+	if ref["id"] != "msg_ABC" || ref["position"] != float64(3) || ref["body"] != nil {
+		t.Errorf("message.appended data = %v", ref)
+	}
+}
@@ -0,0 +1,135 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// chat:<id>:archived counts the messages trimmed from the head of
+// chat:<id>:messages, so index i of the list is position archived+i of the
+// chat's history. It outlives the chat so a chat created again under the same
+// ID continues the history instead of overwriting it.
+func archivedKey(chatID string) string {
+	return "chat:" + chatID + ":archived"
+}
+
+// ArchivedCount returns how many messages of the chat were trimmed from
+// Redis.
+func ArchivedCount(ctx context.Context, rdb *redis.Client, chatID string) (int64, error) {
+	existingChatID, err := FindExistingChatID(ctx, rdb, chatID)
+	if err != nil {
+		return 0, err
+	}
+	n, err := rdb.Get(ctx, archivedKey(existingChatID)).Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	return n, err
+}
+
+// CountMessages returns the number of messages of the chat held in Redis.
+func CountMessages(ctx context.Context, rdb *redis.Client, chatID string) (int64, error) {
+	existingChatID, err := FindExistingChatID(ctx, rdb, chatID)
+	if err != nil {
+		return 0, err
+	}
+	return rdb.LLen(ctx, "chat:"+existingChatID+":messages").Result()
+}
+
+// The functions below address a chat by its stored ID, a member of the chats
+// set, without resolving aliases. The archiver uses them so it reads and
+// trims the keys of the chat it locked even when an alias of that ID points
+// at a duplicate chat.
+
+// StoredChat returns the header of the chat stored under chatID.
+func StoredChat(ctx context.Context, rdb *redis.Client, chatID string) (map[string]interface{}, error) {
+	header, _, err := readHeader(ctx, rdb, "chat:"+chatID)
+	return header, err
+}
+
+// StoredMessages returns the messages of the chat stored under chatID between
+// start and stop, inclusive, with LRANGE semantics.
+func StoredMessages(ctx context.Context, rdb *redis.Client, chatID string, start, stop int64) ([]string, error) {
+	return rdb.LRange(ctx, "chat:"+chatID+":messages", start, stop).Result()
+}
+
+// StoredCounts returns how many messages the chat stored under chatID holds
+// in Redis and how many were archived before them.
+func StoredCounts(ctx context.Context, rdb *redis.Client, chatID string) (length, archived int64, err error) {
+	var lengthCmd *redis.IntCmd
+	var archivedCmd *redis.StringCmd
+	_, err = rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		lengthCmd = pipe.LLen(ctx, "chat:"+chatID+":messages")
+		archivedCmd = pipe.Get(ctx, archivedKey(chatID))
+		return nil
+	})
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return 0, 0, err
+	}
+	archived, err = archivedCmd.Int64()
+	if errors.Is(err, redis.Nil) {
+		archived, err = 0, nil
+	}
+	return lengthCmd.Val(), archived, err
+}
+
+// TrimMessages removes the n oldest messages of the chat, which the caller
+// must have archived, and advances its archived count. chatID is the stored
+// ID, not resolved through aliases. Appends only touch the tail, so they can
+// run concurrently.
+func TrimMessages(ctx context.Context, rdb *redis.Client, chatID string, n int64) error {
+	_, err := rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LTrim(ctx, "chat:"+chatID+":messages", n, -1)
+		pipe.IncrBy(ctx, archivedKey(chatID), n)
+		return nil
+	})
+	return err
+}
+
+// DropChat removes a chat whose messages have all been archived: its header
+// and its entries in the chats set and the activity indexes. The aliases
+// pointing at it are kept so its history is still found under its ID;
+// resolution skips aliases of missing chats and relinks them when the chat is
+// created again. The chat is kept if a message arrived meanwhile or if drop
+// no longer holds for its header. It reports whether the chat was dropped.
+func DropChat(ctx context.Context, rdb *redis.Client, chatID string, drop func(header map[string]interface{}) bool) (bool, error) {
+	chatKey := "chat:" + chatID
+	messagesKey := chatKey + ":messages"
+	dropped := false
+	err := rdb.Watch(ctx, func(tx *redis.Tx) error {
+		dropped = false
+		remaining, err := tx.LLen(ctx, messagesKey).Result()
+		if err != nil {
+			return err
+		}
+		if remaining > 0 {
+			return nil
+		}
+		header, _, err := readHeader(ctx, tx, chatKey)
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return err
+		}
+		if header != nil && !drop(header) {
+			return nil
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, chatKey, messagesKey)
+			pipe.SRem(ctx, "chats", chatID)
+			pipe.ZRem(ctx, ActivityKey, chatID)
+			queueInbox(ctx, pipe, chatID, header, nil, 0)
+			return nil
+		})
+		if err == nil {
+			dropped = true
+		}
+		return err
+	}, chatKey, messagesKey)
+	if errors.Is(err, redis.TxFailedErr) {
+		log.Printf("Chat %s changed while dropping it, keeping it", chatID)
+		return false, nil
+	}
+	return dropped, err
+}
@@ -0,0 +1,28 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// maxTxAttempts bounds how often a WATCH/MULTI transaction is retried when one
+// of its keys changes before EXEC.
+const maxTxAttempts = 10
+
+// watch runs fn in a WATCH transaction on keys, retrying it while the keys
+// keep changing underneath it.
+func watch(ctx context.Context, rdb *redis.Client, fn func(tx *redis.Tx) error, keys ...string) error {
+	for attempt := 0; attempt < maxTxAttempts; attempt++ {
+		err := rdb.Watch(ctx, fn, keys...)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("%v kept changing after %d attempts: %w", keys, maxTxAttempts, redis.TxFailedErr)
+}